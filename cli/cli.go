@@ -2,6 +2,7 @@ package cli
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 
 	"github.com/arnopensource/devo/config"
@@ -18,11 +19,21 @@ func Run(args []string, configFileName string) error {
 	case "quit":
 		return StopDaemon(configFileName)
 	case "reload":
-		return ReloadConfiguration()
+		return ReloadConfiguration(configFileName)
 	case "restart":
-		return RestartService()
+		return RestartService(configFileName, args[1:])
+	case "history":
+		return DisplayHistory(configFileName, args[1:])
+	case "rollback":
+		return RollbackService(configFileName, args[1:])
+	case "gc":
+		return CollectGarbage(configFileName)
+	case "logs":
+		return DisplayLogs(configFileName, args[1:])
+	case "events":
+		return DisplayEvents(configFileName, args[1:])
 	case "status":
-		return DisplayStatus()
+		return DisplayStatus(configFileName, args[1:])
 	case "debug":
 		return Debug()
 	case "check":
@@ -43,7 +54,7 @@ func StartDaemon(configFileName string) error {
 	_, err = daemon.GetProcess(devoConfig)
 	if err != nil {
 		fmt.Println("Starting daemon")
-		daemon.Fork(devoConfig)
+		daemon.Fork(configFileName, devoConfig)
 	} else {
 		fmt.Println("Daemon running")
 	}
@@ -71,20 +82,89 @@ func StopDaemon(configFileName string) error {
 	return nil
 }
 
-func ReloadConfiguration() error {
-	return errors.New("Not implemented")
+func ReloadConfiguration(configFileName string) error {
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	var result daemon.ReloadResult
+	err = daemon.Call(devoConfig, daemon.CommandReload, nil, &result)
+	if err != nil {
+		return fmt.Errorf("Could not reload configuration: %s", err)
+	}
+
+	for _, name := range result.Added {
+		fmt.Println("Added", name)
+	}
+	for _, name := range result.Removed {
+		fmt.Println("Removed", name)
+	}
+	for _, name := range result.Restarted {
+		fmt.Println("Restarted", name)
+	}
+	fmt.Printf("Configuration reloaded, %d services unchanged\n", len(result.Unchanged))
+
+	return printResults(result.Failed, "", "reload")
 }
 
-func RestartService() error {
-	return errors.New("Not implemented")
+func RestartService(configFileName string, args []string) error {
+	flags := flag.NewFlagSet("restart", flag.ContinueOnError)
+	all := flags.Bool("all", false, "restart every service")
+
+	// Flags may come after the services
+	var services []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		services = append(services, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if !*all && len(services) == 0 {
+		return errors.New("Usage: devo restart <service...> | devo restart --all")
+	}
+
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	var results []daemon.ServiceResult
+	err = daemon.Call(devoConfig, daemon.CommandRestart, daemon.RestartArgs{Services: services, All: *all}, &results)
+	if err != nil {
+		return fmt.Errorf("Could not restart services: %s", err)
+	}
+
+	return printResults(results, "Restarted", "restart")
 }
 
 func Debug() error {
 	return errors.New("Not implemented")
 }
 
-func DisplayStatus() error {
-	return errors.New("Not implemented")
+func CollectGarbage(configFileName string) error {
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	var result daemon.GCResult
+	err = daemon.Call(devoConfig, daemon.CommandGC, nil, &result)
+	if err != nil {
+		return fmt.Errorf("Could not collect garbage: %s", err)
+	}
+
+	for _, file := range result.Removed {
+		fmt.Println("Removed", file)
+	}
+	fmt.Printf("Reclaimed %.1f MB\n", float64(result.Reclaimed)/(1024*1024))
+	return nil
 }
 
 func CheckConfiguration(configFileName string) error {
@@ -99,6 +179,25 @@ func DisplayHelp() error {
 	return errors.New("Not implemented")
 }
 
+// printResults prints the outcome of a command for each service
+// and returns an error if it failed for at least one of them
+func printResults(results []daemon.ServiceResult, success string, action string) error {
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			fmt.Printf("Could not %s %s: %s\n", action, result.Name, result.Error)
+			failed++
+		} else {
+			fmt.Printf("%s %s\n", success, result.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d services failed", failed, len(results))
+	}
+	return nil
+}
+
 func getConfig(configFileName string) (*config.Config, error) {
 	conf, err := config.Parse(configFileName)
 	if err != nil {
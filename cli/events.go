@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/arnopensource/devo/daemon"
+)
+
+// DisplayEvents prints the lifecycle events of the services as JSON lines, as they happen
+func DisplayEvents(configFileName string, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	types := flags.String("type", "", "comma separated types of the events to print, like started,exited")
+
+	// Flags may come after the services
+	var services []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		services = append(services, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	eventsArgs := daemon.EventsArgs{Services: services}
+	if *types != "" {
+		eventsArgs.Types = strings.Split(*types, ",")
+	}
+
+	err = daemon.Stream(devoConfig, daemon.CommandEvents, eventsArgs, func(data json.RawMessage) error {
+		_, err := fmt.Println(string(data))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not get events: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/arnopensource/devo/daemon"
+)
+
+func DisplayHistory(configFileName string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: devo history <service>")
+	}
+
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	var history daemon.HistoryResult
+	err = daemon.Call(devoConfig, daemon.CommandHistory, daemon.ServiceArgs{Service: args[0]}, &history)
+	if err != nil {
+		return fmt.Errorf("Could not get history: %s", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "\tVERSION\tCOPIED\tSIZE\tHASH\tBINARY")
+	for i := len(history.Versions) - 1; i >= 0; i-- {
+		binary := history.Versions[i]
+		current := ""
+		if binary.Version == history.Current {
+			current = "*"
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%d\t%.12s\t%s\n",
+			current,
+			binary.Version,
+			binary.Time.Format("2006-01-02 15:04:05"),
+			binary.Size,
+			binary.Hash,
+			binary.File,
+		)
+	}
+	return writer.Flush()
+}
+
+func RollbackService(configFileName string, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: devo rollback <service> [version]")
+	}
+
+	rollbackArgs := daemon.RollbackArgs{Service: args[0]}
+	if len(args) == 2 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version <= 0 {
+			return errors.New("Version must be a positive number, see 'devo history " + args[0] + "'")
+		}
+		rollbackArgs.Version = version
+	}
+
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	var binary daemon.BinaryVersion
+	err = daemon.Call(devoConfig, daemon.CommandRollback, rollbackArgs, &binary)
+	if err != nil {
+		return fmt.Errorf("Could not roll back %s: %s", args[0], err)
+	}
+
+	fmt.Printf("Rolled back %s to version %d (%s)\n", args[0], binary.Version, binary.File)
+	return nil
+}
@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/arnopensource/devo/daemon"
+)
+
+// ANSI colors of the service prefixes
+var logColors = []string{"36", "33", "32", "35", "34", "31"}
+
+func DisplayLogs(configFileName string, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := flags.Bool("f", false, "keep printing the new lines")
+	flags.BoolVar(follow, "follow", false, "keep printing the new lines")
+	lines := flags.Int("n", 100, "number of past lines to print, 0 for all of them")
+	since := flags.Duration("since", 0, "only print the lines of this last duration, like 10m")
+	stderr := flags.Bool("stderr", false, "only print the error output")
+
+	// Flags may come after the services
+	var services []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		services = append(services, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	logsArgs := daemon.LogsArgs{Services: services, Follow: *follow, Lines: *lines, Stderr: *stderr}
+	if *since > 0 {
+		start := time.Now().Add(-*since)
+		logsArgs.Since = &start
+	}
+
+	// Same color for a service whatever the services displayed
+	width := 0
+	colors := make(map[string]string)
+	for i, service := range devoConfig.Services {
+		colors[service.Name] = logColors[i%len(logColors)]
+		if len(service.Name) > width {
+			width = len(service.Name)
+		}
+	}
+	info, err := os.Stdout.Stat()
+	colored := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	err = daemon.Stream(devoConfig, daemon.CommandLogs, logsArgs, func(data json.RawMessage) error {
+		var line daemon.LogLine
+		err := json.Unmarshal(data, &line)
+		if err != nil {
+			return fmt.Errorf("unable to decode log line: %s", err)
+		}
+
+		prefix := fmt.Sprintf("%-*s |", width, line.Service)
+		if colored {
+			prefix = "\x1b[" + colors[line.Service] + "m" + prefix + "\x1b[0m"
+		}
+		if line.Stream == daemon.StreamStderr && !*stderr {
+			prefix += "!"
+		} else {
+			prefix += " "
+		}
+		_, err = fmt.Println(prefix, line.Line)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not get logs: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arnopensource/devo/daemon"
+)
+
+func DisplayStatus(configFileName string, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	jsonOutput := flags.Bool("json", false, "print the status as JSON")
+	lines := flags.Int("n", 0, "print the last lines written by each service")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	devoConfig, err := getConfig(configFileName)
+	if err != nil {
+		return err
+	}
+
+	var statuses []daemon.ServiceStatus
+	err = daemon.Call(devoConfig, daemon.CommandStatus, daemon.StatusArgs{Lines: *lines}, &statuses)
+	if err != nil {
+		return fmt.Errorf("Could not get status from daemon: %s", err)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERVICE\tSTATE\tHEALTH\tPID\tUPTIME\tRESTARTS\tEXIT CODE\tBINARY\tBUILD")
+	for _, status := range statuses {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			status.Name,
+			status.State,
+			orDash(status.Health != "", string(status.Health)),
+			orDash(status.Pid != 0, strconv.Itoa(status.Pid)),
+			orDash(status.StartedAt != nil, (time.Duration(status.Uptime)*time.Second).String()),
+			status.Restarts,
+			orDash(status.ExitCode != nil, exitCodeString(status.ExitCode)),
+			orDash(status.Binary != "", status.Binary),
+			buildString(status.Build),
+		)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		if status.Warning != "" {
+			fmt.Printf("Warning : service %s %s\n", status.Name, status.Warning)
+		}
+	}
+
+	for _, status := range statuses {
+		if len(status.Output) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", status.Name)
+		for _, line := range status.Output {
+			fmt.Printf("  %s %s\n", line.Time.Format("15:04:05"), line.Line)
+		}
+	}
+	return nil
+}
+
+func buildString(build *daemon.BuildStatus) string {
+	if build == nil {
+		return "-"
+	} else if !build.Success {
+		return "failed"
+	}
+	return "ok"
+}
+
+func exitCodeString(exitCode *int) string {
+	if exitCode == nil {
+		return ""
+	}
+	return strconv.Itoa(*exitCode)
+}
+
+func orDash(ok bool, value string) string {
+	if !ok {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+// SplitCommand splits a command line into words like a POSIX shell does, without running a shell
+// Single quotes keep their content as is, double quotes only interpret $ and \ escapes,
+// and $VAR or ${VAR} is replaced by lookup(VAR) outside single quotes
+// Expanded values are never split into several words
+func SplitCommand(command string, lookup func(string) string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case c == '\\':
+			inWord = true
+			if i+1 == len(command) {
+				return nil, errors.New("command ends with an escape character")
+			}
+			i++
+			if command[i] != '\n' {
+				word.WriteByte(command[i])
+			}
+
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote in command")
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				switch {
+				case command[i] == '\\' && i+1 < len(command) && strings.IndexByte("$`\"\\\n", command[i+1]) >= 0:
+					i++
+					if command[i] != '\n' {
+						word.WriteByte(command[i])
+					}
+				case command[i] == '$':
+					value, length, err := expandVariable(command[i:], lookup)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(value)
+					i += length - 1
+				default:
+					word.WriteByte(command[i])
+				}
+			}
+			if i == len(command) {
+				return nil, errors.New("unterminated double quote in command")
+			}
+
+		case c == '$':
+			inWord = true
+			value, length, err := expandVariable(command[i:], lookup)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			i += length - 1
+
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandVariable expands the variable at the start of text, which starts with $
+// It returns the value and the length of the expanded text
+func expandVariable(text string, lookup func(string) string) (string, int, error) {
+	if len(text) > 1 && text[1] == '{' {
+		end := strings.IndexByte(text, '}')
+		if end < 0 {
+			return "", 0, errors.New("unterminated ${ in command")
+		}
+		name := text[2:end]
+		if !isVariableName(name) {
+			return "", 0, errors.New("invalid variable name in command: " + name)
+		}
+		return lookup(name), end + 1, nil
+	}
+
+	length := 1
+	for length < len(text) && isVariableChar(text[length], length == 1) {
+		length++
+	}
+	if length == 1 {
+		// A lone $ is kept
+		return "$", 1, nil
+	}
+	return lookup(text[1:length]), length, nil
+}
+
+func isVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isVariableChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isVariableChar(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
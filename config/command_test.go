@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	variables := map[string]string{
+		"PORT":  "8080",
+		"NAME":  "my service",
+		"EMPTY": "",
+	}
+	lookup := func(name string) string {
+		return variables[name]
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		words   []string
+		invalid bool
+	}{
+		{name: "plain words", command: "server  --port\t8080\n", words: []string{"server", "--port", "8080"}},
+		{name: "empty", command: "  ", words: nil},
+		{name: "single quotes", command: `echo 'a  b' 'c"d' '$PORT' '\n'`, words: []string{"echo", "a  b", `c"d`, "$PORT", `\n`}},
+		{name: "double quotes", command: `echo "a  b" "c'd" "$PORT"`, words: []string{"echo", "a  b", "c'd", "8080"}},
+		{name: "empty quotes", command: `echo '' ""`, words: []string{"echo", "", ""}},
+		{name: "quotes joined to a word", command: `--name="a b"'c d'e`, words: []string{"--name=a bc de"}},
+		{name: "escapes outside quotes", command: `echo a\ b \$PORT \'x\" \\`, words: []string{"echo", "a b", "$PORT", `'x"`, `\`}},
+		{name: "escaped newline outside quotes", command: "echo a\\\nb", words: []string{"echo", "ab"}},
+		{name: "escapes inside double quotes", command: `echo "\$PORT \"q\" \\ \n \a"`, words: []string{"echo", `$PORT "q" \ \n \a`}},
+		{name: "escaped newline inside double quotes", command: "echo \"a\\\nb\"", words: []string{"echo", "ab"}},
+		{name: "variable", command: "server --port $PORT", words: []string{"server", "--port", "8080"}},
+		{name: "braced variable", command: "server --addr=:${PORT}0", words: []string{"server", "--addr=:80800"}},
+		{name: "variable ends at a non name character", command: "$PORT.txt", words: []string{"8080.txt"}},
+		{name: "unknown variable", command: "echo $UNKNOWN", words: []string{"echo", ""}},
+		{name: "empty variable keeps the word", command: "echo $EMPTY x", words: []string{"echo", "", "x"}},
+		{name: "lone dollar", command: "echo $ a$ $1", words: []string{"echo", "$", "a$", "$1"}},
+		{name: "lone dollar in double quotes", command: `echo "$ $"`, words: []string{"echo", "$ $"}},
+		{name: "expanded value with spaces is one word", command: "server --name $NAME", words: []string{"server", "--name", "my service"}},
+		{name: "braced value with spaces is one word", command: "server ${NAME}!", words: []string{"server", "my service!"}},
+		{name: "quoted value with spaces is one word", command: `server "$NAME"`, words: []string{"server", "my service"}},
+		{name: "invalid braced variable", command: "echo ${1x}", invalid: true},
+		{name: "empty braced variable", command: "echo ${}", invalid: true},
+		{name: "invalid braced variable in double quotes", command: `echo "${a-b}"`, invalid: true},
+		{name: "unterminated braced variable", command: "echo ${PORT", invalid: true},
+		{name: "unterminated single quote", command: "echo 'abc", invalid: true},
+		{name: "unterminated double quote", command: `echo "abc`, invalid: true},
+		{name: "unterminated double quote after an escape", command: `echo "abc\"`, invalid: true},
+		{name: "trailing escape", command: `echo \`, invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			words, err := SplitCommand(test.command, lookup)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("SplitCommand(%q) = %q, expected an error", test.command, words)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SplitCommand(%q) returned error: %s", test.command, err)
+			}
+			if !reflect.DeepEqual(words, test.words) {
+				t.Errorf("SplitCommand(%q) = %q, expected %q", test.command, words, test.words)
+			}
+		})
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -16,7 +18,12 @@ import (
 
 type Config struct {
 	KillDelay int `toml:"kill_delay"`
+	// "text" or "json" to log structured events
+	LogFormat string `toml:"log_format"`
 	Storage   Storage
+	Caddy     Caddy
+	Metrics   Metrics
+	Proxy     Proxy
 	Services  []Service `toml:"service"`
 }
 
@@ -24,18 +31,66 @@ type Storage struct {
 	PidFile  string `toml:"pid_file"`
 	SockFile string `toml:"sock_file"`
 	Binaries string
-	Log      string
+	// Log file of the daemon. Like the service logs, it can contain a date as {2006-01-02} and is reopened when the date changes
+	Log string
+	// Rotation of the logs bigger than log_max_size megabytes, keeping log_keep files. 0 disables it
+	// Logs named after a date also keep the files of the last log_keep previous dates
+	LogMaxSize  int  `toml:"log_max_size"`
+	LogKeep     int  `toml:"log_keep"`
+	LogCompress bool `toml:"log_compress"`
+	// Number of recent lines kept in memory for each service, for devo logs and crash reports
+	OutputLines int `toml:"output_lines"`
+	// Number of binaries kept per service for rollbacks
+	History int
+	// Limits of the binaries folder, in megabytes and hours. 0 means no limit
+	MaxBinariesSize int `toml:"max_binaries_size"`
+	MaxBinariesAge  int `toml:"max_binaries_age"`
+}
+
+type Caddy struct {
+	// Address of the Caddy admin API
+	Admin string
+	// Name of the Caddy HTTP server holding the routes of the services, created if needed
+	Server string
+	Listen []string
+}
+
+// Proxy is the reverse proxy built into the daemon, routing the caddy hosts of the services instead of Caddy
+type Proxy struct {
+	// Address like :8080 or localhost:80. Disabled when empty
+	Listen string
+	// Seconds a request waits for a service that is restarting
+	Hold int
+}
+
+type Metrics struct {
+	// Address of the Prometheus metrics endpoint, like localhost:9100. Disabled when empty
+	Listen string
 }
 
 type Service struct {
 	Name       string
 	BinaryPath string `toml:"binary_path"`
-	Command    string
-	Dir        string
-	Restart    struct {
+	// Command line split like a shell does, or the arguments as is. Both accept $VAR, {binary}, {name}, {dir} and {port}
+	Command   string
+	Args      []string
+	Dir       string
+	Port      int
+	DependsOn []string `toml:"depends_on"`
+	// Signal asking the service to stop, and seconds to wait before killing it. Defaults to SIGTERM and the global kill_delay
+	StopSignal string `toml:"stop_signal"`
+	KillDelay  int    `toml:"kill_delay"`
+	// Linux only: kill the service when the daemon dies, even if it could not stop it
+	KillWithDaemon bool `toml:"kill_with_daemon"`
+	Restart        struct {
 		OnChange bool `toml:"on_change"`
 		OnError  bool `toml:"on_error"`
 		OnExit   bool `toml:"on_exit"`
+		// Backoff policy, in seconds. The delay doubles after each restart within the retry window
+		Delay       int `toml:"delay"`
+		MaxDelay    int `toml:"max_delay"`
+		MaxRetries  int `toml:"max_retries"`
+		RetryWindow int `toml:"retry_window"`
 	}
 	Caddy struct {
 		Enable bool
@@ -45,6 +100,46 @@ type Service struct {
 		Stdout string
 		Stderr string
 	}
+	// Files restarting the service when they change: files, directories or glob patterns
+	Watch struct {
+		Paths  []string
+		Ignore []string
+	}
+	// Probe telling if the service is healthy: an HTTP GET, a TCP connection or a command
+	Health struct {
+		Type    string
+		Port    int
+		Path    string
+		Command string
+		// In seconds
+		Interval int
+		Timeout  int
+		// Consecutive failures before the service is unhealthy
+		Threshold int `toml:"failure_threshold"`
+		Restart   bool
+	}
+	// Restarts starting the new process next to the current one, which is stopped once the new one is ready
+	Handoff struct {
+		// Sockets opened by devo and passed to the service systemd style, as fds 3 and up with LISTEN_FDS and LISTEN_PID
+		// Addresses like :8080, localhost:8080 or unix:/tmp/service.sock
+		// The service tells it is ready by sending READY=1 to NOTIFY_SOCKET, as with sd_notify
+		Listen []string
+		// Or blue/green: the new process runs on the other port, {port} tells which one, and the route switches to it
+		SwapPort int `toml:"swap_port"`
+		// Seconds the new process must stay up before replacing the previous one
+		ReadyDelay int `toml:"ready_delay"`
+		// Seconds the new process has to notify it is ready on shared sockets, or to pass the health check on the swap port,
+		// or to accept connections on it without health check
+		ReadyTimeout int `toml:"ready_timeout"`
+	}
+	// Command rebuilding the binary when the watched sources change
+	Build struct {
+		Command string
+		Dir     string
+		Watch   []string
+		Ignore  []string
+		Env     map[string]string
+	}
 	Env map[string]string
 }
 
@@ -52,11 +147,23 @@ func Parse(configFilename string) (*Config, error) {
 	// Default options
 	config := &Config{
 		KillDelay: 5,
+		LogFormat: "text",
 		Storage: Storage{
-			PidFile:  "~/.devo/devo.pid",
-			SockFile: "~/.devo/devo.sock",
-			Binaries: "~/.devo/bin/",
-			Log:      "~/.devo/devo.log",
+			PidFile:     "~/.devo/devo.pid",
+			SockFile:    "~/.devo/devo.sock",
+			Binaries:    "~/.devo/bin/",
+			History:     5,
+			Log:         "~/.devo/devo.log",
+			LogKeep:     5,
+			OutputLines: 1000,
+		},
+		Caddy: Caddy{
+			Admin:  "localhost:2019",
+			Server: "devo",
+			Listen: []string{":80"},
+		},
+		Proxy: Proxy{
+			Hold: 5,
 		},
 	}
 
@@ -103,6 +210,25 @@ func check(devoConfig *Config) error {
 		return errors.New("kill_delay must be greater than 0")
 	}
 
+	if devoConfig.LogFormat != "text" && devoConfig.LogFormat != "json" {
+		return errors.New("log_format must be text or json")
+	}
+
+	if devoConfig.Proxy.Listen != "" {
+		if _, _, err := net.SplitHostPort(devoConfig.Proxy.Listen); err != nil {
+			return fmt.Errorf("invalid proxy listen address: %s", err)
+		}
+	}
+	if devoConfig.Proxy.Hold < 0 {
+		return errors.New("proxy hold must be positive")
+	}
+
+	if devoConfig.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(devoConfig.Metrics.Listen); err != nil {
+			return fmt.Errorf("invalid metrics listen address: %s", err)
+		}
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return err
@@ -137,6 +263,16 @@ func check(devoConfig *Config) error {
 		return errors.New("binaries is not a directory: " + devoConfig.Storage.Binaries)
 	}
 
+	if devoConfig.Storage.History <= 0 {
+		return errors.New("history must be greater than 0")
+	}
+	if devoConfig.Storage.MaxBinariesSize < 0 {
+		return errors.New("max_binaries_size must be positive")
+	}
+	if devoConfig.Storage.MaxBinariesAge < 0 {
+		return errors.New("max_binaries_age must be positive")
+	}
+
 	if devoConfig.Storage.Log[0] == '~' {
 		devoConfig.Storage.Log = path.Join(homeDir, devoConfig.Storage.Log[1:])
 	}
@@ -145,7 +281,19 @@ func check(devoConfig *Config) error {
 	if err != nil {
 		return errors.New("log file directory does not exist: " + devoConfig.Storage.Log)
 	}
-	devoConfig.Storage.Log = UseDateInFilename(devoConfig.Storage.Log)
+	if devoConfig.Storage.LogMaxSize < 0 || devoConfig.Storage.LogKeep < 0 {
+		return errors.New("log_max_size and log_keep must be positive")
+	}
+	if devoConfig.Storage.OutputLines < 0 {
+		return errors.New("output_lines must be positive")
+	}
+
+	if devoConfig.Caddy.Admin == "" {
+		return errors.New("caddy admin address is empty")
+	}
+	if devoConfig.Caddy.Server == "" {
+		return errors.New("caddy server name is empty")
+	}
 
 	serviceNames := make(map[string]bool)
 	for i, service := range devoConfig.Services {
@@ -189,9 +337,40 @@ func check(devoConfig *Config) error {
 			}
 		}
 
+		err = checkRestartPolicy(&devoConfig.Services[i])
+		if err != nil {
+			return err
+		}
+
+		if service.Command != "" && len(service.Args) > 0 {
+			return errors.New("Service command and args cannot be used together for " + service.Name)
+		}
+		err = checkCommand(service.Command, "command", service.Name)
+		if err != nil {
+			return err
+		}
+
+		if service.StopSignal == "" {
+			devoConfig.Services[i].StopSignal = "SIGTERM"
+		} else if _, ok := Signal(service.StopSignal); !ok {
+			return errors.New("Service stop_signal is not a known signal for " + service.Name)
+		}
+		if service.KillDelay < 0 {
+			return errors.New("Service kill_delay must be positive for " + service.Name)
+		} else if service.KillDelay == 0 {
+			devoConfig.Services[i].KillDelay = devoConfig.KillDelay
+		}
+
+		if service.Port < 0 || service.Port > 65535 {
+			return errors.New("Service port is invalid for " + service.Name)
+		}
+
 		if service.Caddy.Enable && service.Caddy.Host == "" {
 			return errors.New("Caddy host is empty for " + service.Name)
 		}
+		if service.Caddy.Enable && service.Port == 0 {
+			return errors.New("Service port is needed by Caddy for " + service.Name)
+		}
 
 		if service.Dir != "" {
 			if service.Dir[0] == '~' {
@@ -206,8 +385,249 @@ func check(devoConfig *Config) error {
 				return errors.New("Service execution directory is not a directory: " + devoConfig.Services[i].Dir)
 			}
 		}
+
+		err = checkWatch(devoConfig.Services[i].Watch.Paths, devoConfig.Services[i].Watch.Ignore, devoConfig.Services[i].Dir, homeDir)
+		if err != nil {
+			return err
+		}
+
+		err = checkBuild(&devoConfig.Services[i], homeDir)
+		if err != nil {
+			return err
+		}
+
+		err = checkHealth(&devoConfig.Services[i])
+		if err != nil {
+			return err
+		}
+
+		err = checkHandoff(&devoConfig.Services[i], homeDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkDependencies(devoConfig)
+}
+
+// checkWatch makes the watched paths absolute, relative paths being relative to baseDir
+func checkWatch(paths []string, ignore []string, baseDir string, homeDir string) error {
+	for i, watchPath := range paths {
+		watchPath, err := absolutePath(watchPath, baseDir, homeDir)
+		if err != nil {
+			return err
+		}
+		if _, err = path.Match(watchPath, ""); err != nil {
+			return errors.New("Service watch pattern is invalid: " + watchPath)
+		}
+		if !strings.ContainsAny(watchPath, `*?[\`) {
+			if _, err = os.Stat(watchPath); err != nil {
+				return errors.New("Service watch path does not exist: " + watchPath)
+			}
+		}
+		paths[i] = watchPath
+	}
+
+	for i, pattern := range ignore {
+		var err error
+		// Patterns without a slash match file names anywhere
+		if strings.Contains(pattern, "/") {
+			pattern, err = absolutePath(pattern, baseDir, homeDir)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = path.Match(pattern, ""); err != nil {
+			return errors.New("Service watch ignore pattern is invalid: " + pattern)
+		}
+		ignore[i] = pattern
+	}
+
+	return nil
+}
+
+func checkHealth(service *Service) error {
+	health := &service.Health
+	switch health.Type {
+	case "":
+		return nil
+	case "http", "tcp":
+		if health.Port == 0 {
+			health.Port = service.Port
+		}
+		if health.Port <= 0 || health.Port > 65535 {
+			return errors.New("Service health check needs a valid port for " + service.Name)
+		}
+	case "exec":
+		if health.Command == "" {
+			return errors.New("Service health check command is empty for " + service.Name)
+		}
+		err := checkCommand(health.Command, "health check command", service.Name)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("Service health check type must be http, tcp or exec for " + service.Name)
+	}
+
+	if health.Interval < 0 || health.Timeout < 0 || health.Threshold < 0 {
+		return errors.New("Service health check values must be positive for " + service.Name)
+	}
+	if health.Interval == 0 {
+		health.Interval = 5
+	}
+	if health.Timeout == 0 {
+		health.Timeout = 2
+	}
+	if health.Threshold == 0 {
+		health.Threshold = 3
+	}
+	if health.Path == "" {
+		health.Path = "/"
+	} else if health.Path[0] != '/' {
+		health.Path = "/" + health.Path
+	}
+	return nil
+}
+
+func checkHandoff(service *Service, homeDir string) error {
+	handoff := &service.Handoff
+	if len(handoff.Listen) == 0 && handoff.SwapPort == 0 {
+		return nil
+	}
+	if len(handoff.Listen) > 0 && handoff.SwapPort != 0 {
+		return errors.New("Service handoff listen and swap_port cannot be used together for " + service.Name)
+	}
+	if handoff.SwapPort != 0 {
+		if handoff.SwapPort < 0 || handoff.SwapPort > 65535 || handoff.SwapPort == service.Port {
+			return errors.New("Service handoff swap_port is invalid for " + service.Name)
+		}
+		if service.Port == 0 || !service.Caddy.Enable {
+			return errors.New("Service handoff swap_port needs a port and a route for " + service.Name)
+		}
+	}
+
+	for i, address := range handoff.Listen {
+		network, listenAddress := ListenAddress(address)
+		if network == "unix" {
+			socketPath, err := absolutePath(listenAddress, service.Dir, homeDir)
+			if err != nil {
+				return err
+			}
+			if _, err = os.Stat(path.Dir(socketPath)); err != nil {
+				return errors.New("Service handoff socket directory does not exist: " + socketPath)
+			}
+			handoff.Listen[i] = "unix:" + socketPath
+		} else if _, _, err := net.SplitHostPort(listenAddress); err != nil {
+			return fmt.Errorf("Service handoff listen address is invalid for %s: %s", service.Name, err)
+		}
+	}
+
+	if handoff.ReadyDelay < 0 || handoff.ReadyTimeout < 0 {
+		return errors.New("Service handoff values must be positive for " + service.Name)
+	}
+	if handoff.ReadyDelay == 0 {
+		handoff.ReadyDelay = 1
+	}
+	if handoff.ReadyTimeout == 0 {
+		handoff.ReadyTimeout = 30
+	}
+	return nil
+}
+
+// ListenAddress returns the network and the address of a handoff socket
+func ListenAddress(address string) (string, string) {
+	if strings.HasPrefix(address, "unix:") {
+		return "unix", strings.TrimPrefix(address, "unix:")
+	}
+	return "tcp", address
+}
+
+// checkCommand checks the quotes and escapes of a command, its variables are only known when it runs
+func checkCommand(command string, kind string, service string) error {
+	if command == "" {
+		return nil
+	}
+	_, err := SplitCommand(command, func(string) string { return "" })
+	if err != nil {
+		return fmt.Errorf("Service %s is invalid for %s: %s", kind, service, err)
+	}
+	return nil
+}
+
+func checkBuild(service *Service, homeDir string) error {
+	build := &service.Build
+	if build.Command == "" {
+		if len(build.Watch) > 0 {
+			return errors.New("Service build command is empty for " + service.Name)
+		}
+		return nil
+	}
+	if len(build.Watch) == 0 {
+		return errors.New("Service build has no source to watch for " + service.Name)
+	}
+	err := checkCommand(build.Command, "build command", service.Name)
+	if err != nil {
+		return err
+	}
+
+	if build.Dir == "" {
+		build.Dir = service.Dir
+	} else {
+		dir, err := absolutePath(build.Dir, service.Dir, homeDir)
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(dir)
+		if err != nil || !stat.IsDir() {
+			return errors.New("Service build directory does not exist: " + dir)
+		}
+		build.Dir = dir
+	}
+
+	return checkWatch(build.Watch, build.Ignore, build.Dir, homeDir)
+}
+
+func absolutePath(filename string, baseDir string, homeDir string) (string, error) {
+	if filename == "" {
+		return "", errors.New("path is empty")
+	}
+	if filename[0] == '~' {
+		filename = path.Join(homeDir, filename[1:])
+	}
+	if !path.IsAbs(filename) && baseDir != "" {
+		filename = path.Join(baseDir, filename)
+	}
+	return filepath.Abs(filename)
+}
+
+func checkRestartPolicy(service *Service) error {
+	restart := &service.Restart
+	if restart.Delay < 0 || restart.MaxDelay < 0 || restart.MaxRetries < 0 || restart.RetryWindow < 0 {
+		return errors.New("Restart policy values must be positive for " + service.Name)
+	}
+
+	// Default policy
+	if restart.Delay == 0 {
+		restart.Delay = 1
+	}
+	if restart.MaxDelay == 0 {
+		// A delay above the default maximum is never capped below itself
+		restart.MaxDelay = 30
+		if restart.Delay > restart.MaxDelay {
+			restart.MaxDelay = restart.Delay
+		}
+	}
+	if restart.MaxRetries == 0 {
+		restart.MaxRetries = 5
+	}
+	if restart.RetryWindow == 0 {
+		restart.RetryWindow = 60
 	}
 
+	if restart.MaxDelay < restart.Delay {
+		return errors.New("Restart max_delay must be greater than delay for " + service.Name)
+	}
 	return nil
 }
 
@@ -230,3 +650,31 @@ func UseDateInFilename(filename string) string {
 
 	return path.Dir(filename) + "/" + base
 }
+
+// IsDatedFilename reports whether name is the base name of the file name template on some date
+func IsDatedFilename(filename string, name string) bool {
+	base := path.Base(filename)
+	params := dateParamRegex.FindAllStringSubmatchIndex(base, -1)
+	if params == nil {
+		return false
+	}
+
+	expression := "^"
+	last := 0
+	for _, param := range params {
+		expression += regexp.QuoteMeta(base[last:param[0]]) + "(.+)"
+		last = param[1]
+	}
+	expression += regexp.QuoteMeta(base[last:]) + "$"
+	match := regexp.MustCompile(expression).FindStringSubmatch(name)
+	if match == nil {
+		return false
+	}
+	for i, param := range params {
+		_, err := time.Parse(base[param[2]:param[3]], match[i+1])
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+// checkDependencies makes sure every dependency exists and that there is no cycle
+func checkDependencies(devoConfig *Config) error {
+	services := make(map[string]*Service, len(devoConfig.Services))
+	for i := range devoConfig.Services {
+		services[devoConfig.Services[i].Name] = &devoConfig.Services[i]
+	}
+
+	for _, service := range devoConfig.Services {
+		for _, dependency := range service.DependsOn {
+			if _, ok := services[dependency]; !ok {
+				return errors.New("Service " + service.Name + " depends on unknown service " + dependency)
+			}
+		}
+	}
+
+	// Depth first search, a service met again while it is being visited closes a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(services))
+	var stack []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, stacked := range stack {
+				if stacked == name {
+					return errors.New("Services dependency cycle: " + strings.Join(append(stack[i:], name), " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dependency := range services[name].DependsOn {
+			err := visit(dependency)
+			if err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, service := range devoConfig.Services {
+		err := visit(service.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartOrder lists the services so that each one comes after its dependencies
+// Services keep their configuration order when possible
+func (c *Config) StartOrder() []string {
+	services := make(map[string]Service, len(c.Services))
+	for _, service := range c.Services {
+		services[service.Name] = service
+	}
+
+	order := make([]string, 0, len(c.Services))
+	added := make(map[string]bool, len(c.Services))
+
+	var add func(name string)
+	add = func(name string) {
+		if added[name] {
+			return
+		}
+		added[name] = true
+		for _, dependency := range services[name].DependsOn {
+			add(dependency)
+		}
+		order = append(order, name)
+	}
+
+	for _, service := range c.Services {
+		add(service.Name)
+	}
+	return order
+}
+
+// Dependents lists the services depending directly or indirectly on a service, in start order
+func (c *Config) Dependents(name string) []string {
+	dependent := map[string]bool{name: true}
+	var dependents []string
+
+	for _, candidate := range c.StartOrder() {
+		for _, service := range c.Services {
+			if service.Name != candidate {
+				continue
+			}
+			for _, dependency := range service.DependsOn {
+				if dependent[dependency] && !dependent[candidate] {
+					dependent[candidate] = true
+					dependents = append(dependents, candidate)
+				}
+			}
+		}
+	}
+	return dependents
+}
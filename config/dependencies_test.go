@@ -0,0 +1,94 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dependencyConfig builds a configuration from "name:dependency,dependency" declarations
+func dependencyConfig(declarations ...string) *Config {
+	devoConfig := &Config{}
+	for _, declaration := range declarations {
+		parts := strings.SplitN(declaration, ":", 2)
+		service := Service{Name: parts[0]}
+		if len(parts) == 2 && parts[1] != "" {
+			service.DependsOn = strings.Split(parts[1], ",")
+		}
+		devoConfig.Services = append(devoConfig.Services, service)
+	}
+	return devoConfig
+}
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []string
+		err      string
+	}{
+		{name: "no dependency", services: []string{"a", "b"}},
+		{name: "chain", services: []string{"a:b", "b:c", "c"}},
+		{name: "diamond", services: []string{"app:api,worker", "api:db", "worker:db", "db"}},
+		{name: "missing dependency", services: []string{"a:b"}, err: "Service a depends on unknown service b"},
+		{name: "self dependency", services: []string{"a:a"}, err: "Services dependency cycle: a -> a"},
+		{name: "cycle", services: []string{"a:b", "b:c", "c:a"}, err: "Services dependency cycle: a -> b -> c -> a"},
+		{name: "cycle behind a dependency", services: []string{"app:a", "a:b", "b:a"}, err: "Services dependency cycle: a -> b -> a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkDependencies(dependencyConfig(test.services...))
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("error is %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []string
+		order    []string
+	}{
+		{name: "configuration order", services: []string{"a", "b", "c"}, order: []string{"a", "b", "c"}},
+		{name: "dependency declared later", services: []string{"app:db", "db"}, order: []string{"db", "app"}},
+		{name: "chain", services: []string{"a:b", "b:c", "c"}, order: []string{"c", "b", "a"}},
+		{name: "diamond", services: []string{"app:api,worker", "api:db", "worker:db", "db"}, order: []string{"db", "api", "worker", "app"}},
+		{name: "independent services keep their place", services: []string{"x", "app:db", "y", "db"}, order: []string{"x", "db", "app", "y"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order := dependencyConfig(test.services...).StartOrder()
+			if !reflect.DeepEqual(order, test.order) {
+				t.Errorf("StartOrder() = %v, expected %v", order, test.order)
+			}
+		})
+	}
+}
+
+func TestDependents(t *testing.T) {
+	devoConfig := dependencyConfig("app:api,worker", "api:db", "worker:db,cache", "db", "cache", "tool")
+
+	tests := []struct {
+		service    string
+		dependents []string
+	}{
+		{"db", []string{"api", "worker", "app"}},
+		{"cache", []string{"worker", "app"}},
+		{"api", []string{"app"}},
+		{"app", nil},
+		{"tool", nil},
+	}
+
+	for _, test := range tests {
+		dependents := devoConfig.Dependents(test.service)
+		if !reflect.DeepEqual(dependents, test.dependents) {
+			t.Errorf("Dependents(%q) = %v, expected %v", test.service, dependents, test.dependents)
+		}
+	}
+}
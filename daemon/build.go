@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Only the end of the build output is kept in the service status
+const maxBuildOutput = 64 * 1024
+
+// Rebuild runs the build command of the service and restarts it on the new binary
+// If the build fails the running instance is kept
+func (s *Service) Rebuild() error {
+	s.buildMutex.Lock()
+	defer s.buildMutex.Unlock()
+
+	err := s.build()
+	if err != nil {
+		logEvent(Event{Type: EventBuildFailed, Level: LevelError, Service: s.name, Reason: err.Error(),
+			Message: fmt.Sprintf("Build of service %v failed, keeping the running instance: %v", s.name, err)})
+		return err
+	}
+
+	changed, err := s.BinaryChanged()
+	if err != nil {
+		logMessage(LevelError, s.name, fmt.Sprintf("Cannot read binary of service %v: %v", s.name, err))
+		return err
+	} else if !changed && s.IsRunning() {
+		logEvent(Event{Type: EventRestartSkipped, Service: s.name, Reason: ReasonBuild,
+			Message: fmt.Sprintf("Service %v binary unchanged, restart skipped", s.name)})
+		return nil
+	}
+
+	logRestart(s.name, ReasonBuild, fmt.Sprintf("Restarting service %v (build succeeded)", s.name))
+	return s.Restart()
+}
+
+func (s *Service) build() error {
+	serviceConf := s.currentConf()
+	conf := serviceConf.Build
+	// {binary} is the file the build produces
+	args, err := commandArgs(conf.Command, nil, conf.Env, placeholders(serviceConf, serviceConf.BinaryPath))
+	if err != nil {
+		return fmt.Errorf("invalid build command: %s", err)
+	}
+
+	logEvent(Event{Type: EventBuildStarted, Service: s.name, Message: fmt.Sprintf("Building service %v", s.name)})
+
+	var output bytes.Buffer
+	command := exec.Command(args[0], args[1:]...)
+	command.Dir = conf.Dir
+	command.Stdout = &output
+	command.Stderr = &output
+	command.Env = os.Environ()
+	for key, value := range conf.Env {
+		command.Env = append(command.Env, fmt.Sprintf("%v=%v", key, value))
+	}
+
+	startedAt := time.Now()
+	err = command.Run()
+
+	status := &BuildStatus{
+		Time:     startedAt,
+		Duration: time.Since(startedAt).Seconds(),
+		Success:  err == nil,
+		Output:   output.String(),
+	}
+	if len(status.Output) > maxBuildOutput {
+		status.Output = status.Output[len(status.Output)-maxBuildOutput:]
+	}
+
+	s.stateMutex.Lock()
+	s.lastBuild = status
+	s.stateMutex.Unlock()
+
+	if output.Len() > 0 {
+		level := LevelInfo
+		if err != nil {
+			level = LevelError
+		}
+		logEvent(Event{Type: EventBuildOutput, Level: level, Service: s.name,
+			Message: fmt.Sprintf("Build output of service %v:\n%s", s.name, strings.TrimSuffix(output.String(), "\n"))})
+	}
+	if err != nil {
+		return err
+	}
+	logEvent(Event{Type: EventBuildSucceeded, Service: s.name, Message: fmt.Sprintf("Built service %v in %.1fs", s.name, status.Duration)})
+	return nil
+}
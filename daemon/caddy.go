@@ -0,0 +1,178 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arnopensource/devo/config"
+)
+
+// Router exposes a running service on its host
+type Router interface {
+	SetRoute(service string, host string, port int) error
+	RemoveRoute(service string) error
+}
+
+// caddyRouter pushes the routes of the services to a local Caddy through its admin API
+// Each route is tagged with an @id so it can be replaced or deleted without touching the rest of the Caddy configuration
+type caddyRouter struct {
+	admin  string
+	server string
+	listen []string
+	client *http.Client
+
+	mutex       sync.Mutex
+	serverReady bool
+}
+
+func newCaddyRouter(conf config.Caddy) *caddyRouter {
+	admin := conf.Admin
+	if !strings.Contains(admin, "://") {
+		admin = "http://" + admin
+	}
+	return &caddyRouter{
+		admin:  strings.TrimSuffix(admin, "/"),
+		server: conf.Server,
+		listen: conf.Listen,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *caddyRouter) SetRoute(service string, host string, port int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.ensureServer()
+	if err != nil {
+		return err
+	}
+
+	route := map[string]interface{}{
+		"@id": caddyRouteID(service),
+		"match": []interface{}{
+			map[string]interface{}{"host": []string{host}},
+		},
+		"handle": []interface{}{
+			map[string]interface{}{
+				"handler": "reverse_proxy",
+				"upstreams": []interface{}{
+					map[string]interface{}{"dial": fmt.Sprintf("localhost:%d", port)},
+				},
+			},
+		},
+		"terminal": true,
+	}
+
+	// Replace the previous route in place, in a single configuration load, so its host is never left without a route
+	_, err = c.request(http.MethodPatch, "/id/"+caddyRouteID(service), route)
+	if err == errCaddyNotFound {
+		_, err = c.request(http.MethodPost, "/config/apps/http/servers/"+c.server+"/routes", route)
+	}
+	if err != nil {
+		// Caddy may have been restarted without its configuration
+		c.serverReady = false
+		return err
+	}
+	return nil
+}
+
+func (c *caddyRouter) RemoveRoute(service string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.deleteRoute(service)
+}
+
+func (c *caddyRouter) deleteRoute(service string) error {
+	_, err := c.request(http.MethodDelete, "/id/"+caddyRouteID(service), nil)
+	if err == errCaddyNotFound {
+		return nil
+	}
+	return err
+}
+
+// ensureServer creates the devo server in the Caddy configuration, along with its missing parents
+func (c *caddyRouter) ensureServer() error {
+	if c.serverReady {
+		return nil
+	}
+
+	levels := []string{"apps", "http", "servers", c.server}
+	for i := 0; i <= len(levels); i++ {
+		configPath := "/config/" + strings.Join(levels[:i], "/")
+		body, err := c.request(http.MethodGet, configPath, nil)
+		if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(string(body)) != "null" {
+			continue
+		}
+
+		var value interface{} = map[string]interface{}{
+			"listen": c.listen,
+			"routes": []interface{}{},
+		}
+		for j := len(levels) - 1; j >= i; j-- {
+			value = map[string]interface{}{levels[j]: value}
+		}
+		_, err = c.request(http.MethodPost, configPath, value)
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	c.serverReady = true
+	return nil
+}
+
+var errCaddyNotFound = errors.New("not found")
+
+func (c *caddyRouter) request(method string, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, c.admin+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach caddy admin API: %s", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read caddy response: %s", err)
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errCaddyNotFound
+	} else if response.StatusCode >= 300 {
+		return nil, fmt.Errorf("caddy admin API %s %s failed (%s): %s", method, path, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	return responseBody, nil
+}
+
+func caddyRouteID(service string) string {
+	return "devo-" + service
+}
@@ -0,0 +1,166 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arnopensource/devo/config"
+)
+
+type caddyRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+// fakeCaddy records the requests to the admin API, answering with the responses set by path
+type fakeCaddy struct {
+	mutex     sync.Mutex
+	requests  []caddyRequest
+	responses map[string]func(writer http.ResponseWriter)
+}
+
+func newFakeCaddy(t *testing.T) (*fakeCaddy, *caddyRouter) {
+	fake := &fakeCaddy{responses: make(map[string]func(writer http.ResponseWriter))}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, caddyRequest{request.Method, request.URL.Path, string(body)})
+		respond := fake.responses[request.Method+" "+request.URL.Path]
+		fake.mutex.Unlock()
+
+		if respond != nil {
+			respond(writer)
+		} else {
+			writer.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	router := newCaddyRouter(config.Caddy{Admin: server.URL, Server: "devo", Listen: []string{":80"}})
+	return fake, router
+}
+
+func (f *fakeCaddy) respond(method string, path string, status int, body string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.responses[method+" "+path] = func(writer http.ResponseWriter) {
+		writer.WriteHeader(status)
+		writer.Write([]byte(body))
+	}
+}
+
+func (f *fakeCaddy) find(method string, path string) *caddyRequest {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i := range f.requests {
+		if f.requests[i].method == method && f.requests[i].path == path {
+			return &f.requests[i]
+		}
+	}
+	return nil
+}
+
+func TestCaddyEnsureServerCreatesMissingPath(t *testing.T) {
+	fake, router := newFakeCaddy(t)
+	fake.respond(http.MethodGet, "/config/apps", http.StatusOK, "null")
+
+	err := router.ensureServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := fake.find(http.MethodPost, "/config/apps")
+	if created == nil {
+		t.Fatal("apps were not created")
+	}
+	var value map[string]map[string]map[string]map[string]interface{}
+	err = json.Unmarshal([]byte(created.body), &value)
+	if err != nil {
+		t.Fatalf("unexpected body %s: %s", created.body, err)
+	}
+	if server := value["http"]["servers"]["devo"]; server == nil || server["routes"] == nil {
+		t.Errorf("server devo not created: %s", created.body)
+	}
+	if fake.find(http.MethodGet, "/config/apps/http") != nil {
+		t.Error("children of a created path should not be read")
+	}
+}
+
+func TestCaddySetRoute(t *testing.T) {
+	fake, router := newFakeCaddy(t)
+	fake.respond(http.MethodPatch, "/id/devo-web", http.StatusNotFound, `{"error":"unknown object ID"}`)
+
+	err := router.SetRoute("web", "web.localhost", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posted := fake.find(http.MethodPost, "/config/apps/http/servers/devo/routes")
+	if posted == nil {
+		t.Fatal("route was not posted")
+	}
+	var route struct {
+		ID    string `json:"@id"`
+		Match []struct {
+			Host []string
+		}
+		Handle []struct {
+			Handler   string
+			Upstreams []struct {
+				Dial string
+			}
+		}
+	}
+	err = json.Unmarshal([]byte(posted.body), &route)
+	if err != nil {
+		t.Fatalf("unexpected body %s: %s", posted.body, err)
+	}
+	if route.ID != "devo-web" {
+		t.Errorf("route id is %q", route.ID)
+	}
+	if len(route.Match) != 1 || strings.Join(route.Match[0].Host, ",") != "web.localhost" {
+		t.Errorf("route does not match the host: %s", posted.body)
+	}
+	if len(route.Handle) != 1 || len(route.Handle[0].Upstreams) != 1 || route.Handle[0].Upstreams[0].Dial != "localhost:8080" {
+		t.Errorf("route does not proxy to the port: %s", posted.body)
+	}
+}
+
+func TestCaddySetRouteReplacesInPlace(t *testing.T) {
+	fake, router := newFakeCaddy(t)
+
+	err := router.SetRoute("web", "web.localhost", 8081)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched := fake.find(http.MethodPatch, "/id/devo-web")
+	if patched == nil || !strings.Contains(patched.body, `"dial":"localhost:8081"`) {
+		t.Fatal("route was not replaced")
+	}
+	if fake.find(http.MethodDelete, "/id/devo-web") != nil {
+		t.Error("route should not be deleted before being replaced")
+	}
+	if fake.find(http.MethodPost, "/config/apps/http/servers/devo/routes") != nil {
+		t.Error("route should not be added twice")
+	}
+}
+
+func TestCaddyRemoveRouteNotFound(t *testing.T) {
+	fake, router := newFakeCaddy(t)
+	fake.respond(http.MethodDelete, "/id/devo-web", http.StatusNotFound, `{"error":"unknown object ID"}`)
+
+	err := router.RemoveRoute("web")
+	if err != nil {
+		t.Errorf("a missing route should be removed without error: %s", err)
+	}
+	if fake.find(http.MethodDelete, "/id/devo-web") == nil {
+		t.Error("route was not deleted")
+	}
+}
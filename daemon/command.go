@@ -0,0 +1,60 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/arnopensource/devo/config"
+)
+
+// commandArgs builds the arguments of a configured command: the words of command, or args as they are
+// Variables come from env then from the daemon environment, and placeholders are replaced in each argument
+func commandArgs(command string, args []string, env map[string]string, placeholders *strings.Replacer) ([]string, error) {
+	lookup := func(name string) string {
+		if value, ok := env[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	}
+
+	var words []string
+	if command != "" {
+		var err error
+		words, err = config.SplitCommand(command, lookup)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, arg := range args {
+			words = append(words, os.Expand(arg, lookup))
+		}
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	for i, word := range words {
+		words[i] = placeholders.Replace(word)
+	}
+	return words, nil
+}
+
+// placeholders of the commands of a service, binary is the file the command is about
+func placeholders(conf config.Service, binary string) *strings.Replacer {
+	dir := conf.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	port := ""
+	if conf.Port != 0 {
+		port = strconv.Itoa(conf.Port)
+	}
+	return strings.NewReplacer(
+		"{binary}", binary,
+		"{name}", conf.Name,
+		"{dir}", dir,
+		"{port}", port,
+	)
+}
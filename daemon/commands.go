@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// registerCommands binds the control socket commands to the runner
+func (r *runner) registerCommands(server *socketServer) {
+	server.Handle(CommandPing, r.ping)
+	server.Handle(CommandStatus, r.status)
+	server.Handle(CommandRestart, r.restart)
+	server.Handle(CommandReload, func(args json.RawMessage) (interface{}, error) {
+		return r.reload()
+	})
+	server.Handle(CommandHistory, r.history)
+	server.Handle(CommandRollback, r.rollback)
+	server.Handle(CommandGC, func(args json.RawMessage) (interface{}, error) {
+		return r.collectGarbage(), nil
+	})
+	server.HandleStream(CommandLogs, r.logs)
+	server.HandleStream(CommandEvents, r.events)
+}
+
+func (r *runner) ping(args json.RawMessage) (interface{}, error) {
+	return PingResult{Pid: os.Getpid(), StartedAt: r.startedAt}, nil
+}
+
+func (r *runner) status(args json.RawMessage) (interface{}, error) {
+	var statusArgs StatusArgs
+	if args != nil {
+		err := json.Unmarshal(args, &statusArgs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments: %s", err)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	statuses := make([]ServiceStatus, 0, len(r.servicesOrder))
+	for _, name := range r.servicesOrder {
+		status := r.services[name].Status()
+		if statusArgs.Lines > 0 {
+			status.Output = r.services[name].output.recent(statusArgs.Lines)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (r *runner) restart(args json.RawMessage) (interface{}, error) {
+	var restartArgs RestartArgs
+	err := json.Unmarshal(args, &restartArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arguments: %s", err)
+	}
+
+	// Dependents are restarted too, each service once and after its dependencies
+	r.mutex.Lock()
+	selected := make(map[string]bool)
+	var unknown []string
+	for _, name := range restartArgs.Services {
+		if _, ok := r.services[name]; !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		selected[name] = true
+		for _, dependent := range r.config.Dependents(name) {
+			selected[dependent] = true
+		}
+	}
+	var names []string
+	for _, name := range r.config.StartOrder() {
+		if restartArgs.All || selected[name] {
+			names = append(names, name)
+		}
+	}
+	services := r.servicesSnapshot()
+	r.mutex.Unlock()
+
+	if len(names) == 0 && len(unknown) == 0 {
+		return nil, errors.New("no service to restart")
+	}
+
+	results := make([]ServiceResult, 0, len(names)+len(unknown))
+	for _, name := range names {
+		result := ServiceResult{Name: name}
+		waitDependencies(services, services[name].currentConf())
+
+		logRestart(name, ReasonRequested, fmt.Sprintf("Restarting service %v (requested)", name))
+		err = services[name].restartAlone()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	for _, name := range unknown {
+		results = append(results, ServiceResult{Name: name, Error: "unknown service"})
+	}
+	return results, nil
+}
+
+func (r *runner) history(args json.RawMessage) (interface{}, error) {
+	var serviceArgs ServiceArgs
+	err := json.Unmarshal(args, &serviceArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arguments: %s", err)
+	}
+
+	service, err := r.service(serviceArgs.Service)
+	if err != nil {
+		return nil, err
+	}
+	return service.History(), nil
+}
+
+func (r *runner) rollback(args json.RawMessage) (interface{}, error) {
+	var rollbackArgs RollbackArgs
+	err := json.Unmarshal(args, &rollbackArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arguments: %s", err)
+	}
+
+	service, err := r.service(rollbackArgs.Service)
+	if err != nil {
+		return nil, err
+	}
+	return service.Rollback(rollbackArgs.Version)
+}
+
+func (r *runner) service(name string) (*Service, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	service, ok := r.services[name]
+	if !ok {
+		return nil, errors.New("unknown service: " + name)
+	}
+	return service, nil
+}
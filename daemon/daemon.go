@@ -2,32 +2,142 @@ package daemon
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/arnopensource/devo/config"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-func run(config *config.Config, exitSignal chan os.Signal) {
-	fmt.Println()
-	log.Println("Starting devo daemon")
+// runner holds the state of the running daemon
+// It is shared between the watcher loop and the control socket handlers
+type runner struct {
+	configFileName string
+	startedAt      time.Time
+	daemonLog      *logFile
+	watcher        *Watcher
+	reloadMutex    sync.Mutex
+	router         Router
+	proxy          *proxyRouter
+	metrics        *metrics
+	gcMutex        sync.Mutex
+	gcRequests     chan bool
 
-	watcher := NewWatcher()
-	defer watcher.Close()
+	mutex           sync.Mutex
+	config          *config.Config
+	services        map[string]*Service
+	servicesOrder   []string
+	servicesWatches map[string]string
+	filesWatches    map[string]pathMatcher
+	buildWatches    map[string]pathMatcher
+	watchedDirs     map[string]bool
+	pendingRestarts map[string]*time.Timer
+	pendingBuilds   map[string]*time.Timer
+	// Set once the services are stopped for good
+	stopped bool
+	// Restarts started by the watcher, timers and dependencies, stopAll waits for them
+	actions sync.WaitGroup
+}
+
+// Delay to let a batch of watched files change before restarting the service
+const watchRestartDelay = 500 * time.Millisecond
+
+// Maximum time to wait for the dependencies of a service before starting it anyway
+const dependencyReadyTimeout = 30 * time.Second
+
+func run(configFileName string, config *config.Config, signals chan os.Signal) {
+	setLogFormat(config.LogFormat)
+	if config.LogFormat != "json" {
+		fmt.Println()
+	}
+	logEvent(Event{Type: EventDaemonStarted, Pid: os.Getpid(), Message: "Starting devo daemon"})
+
+	r := &runner{
+		configFileName:  configFileName,
+		startedAt:       time.Now(),
+		watcher:         NewWatcher(),
+		metrics:         newMetrics(),
+		config:          config,
+		services:        make(map[string]*Service),
+		servicesWatches: make(map[string]string),
+		filesWatches:    make(map[string]pathMatcher),
+		buildWatches:    make(map[string]pathMatcher),
+		watchedDirs:     make(map[string]bool),
+		pendingRestarts: make(map[string]*time.Timer),
+		pendingBuilds:   make(map[string]*time.Timer),
+		gcRequests:      make(chan bool, 1),
+	}
+	defer r.watcher.Close()
+	defer observeEvents(r.metrics.observe)()
 
-	var services = make(map[string]*Service)
-	var servicesWatches = make(map[string]string)
+	if config.Proxy.Listen != "" {
+		r.proxy = newProxyRouter(config.Proxy, r.service)
+		r.router = r.proxy
+		proxyServer, err := r.proxy.serve(config.Proxy.Listen)
+		if err != nil {
+			logMessage(LevelError, "", fmt.Sprint("Error starting proxy: ", err))
+		} else {
+			defer proxyServer.Close()
+		}
+	} else {
+		r.router = newCaddyRouter(config.Caddy)
+	}
+
+	daemonLog, err := openLogFile(config.Storage.Log, config.Storage, redirectOutput)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprint("Error opening log file, it will not be rotated: ", err))
+	} else {
+		r.daemonLog = daemonLog
+		stopLogChecks := make(chan bool)
+		defer close(stopLogChecks)
+		go r.checkLogLoop(stopLogChecks)
+	}
 
 	for _, service := range config.Services {
-		services[service.Name] = NewService(config.Storage.Binaries, config.KillDelay, service)
-		services[service.Name].Start()
-		defer services[service.Name].Stop()
+		r.services[service.Name] = r.newService(config, service)
+		r.servicesOrder = append(r.servicesOrder, service.Name)
+	}
+	defer r.stopAll()
 
-		if service.Restart.OnChange {
-			servicesWatches[service.BinaryPath] = service.Name
-			watcher.Add(service.BinaryPath)
+	// Served while the services start, which may wait for their dependencies
+	server, err := newSocketServer(config.Storage.SockFile)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprint("Error starting control socket: ", err))
+		logMessage(LevelWarn, "", "Devo will not be able to receive commands")
+	} else {
+		defer server.Close()
+		r.registerCommands(server)
+		server.serve()
+	}
+
+	// A reload requested meanwhile waits for the services to be started
+	r.reloadMutex.Lock()
+	r.mutex.Lock()
+	services := r.servicesSnapshot()
+	r.mutex.Unlock()
+	for _, name := range config.StartOrder() {
+		waitDependencies(services, services[name].currentConf())
+		services[name].Start()
+	}
+	r.mutex.Lock()
+	r.updateWatches()
+	r.mutex.Unlock()
+	r.reloadMutex.Unlock()
+
+	stopGarbageCollection := make(chan bool)
+	defer close(stopGarbageCollection)
+	go r.collectGarbageLoop(stopGarbageCollection)
+	r.requestGarbageCollection()
+
+	if config.Metrics.Listen != "" {
+		metricsServer, err := r.serveMetrics(config.Metrics.Listen)
+		if err != nil {
+			logMessage(LevelError, "", fmt.Sprint("Error starting metrics endpoint: ", err))
+		} else {
+			defer metricsServer.Close()
 		}
 	}
 
@@ -35,20 +145,313 @@ func run(config *config.Config, exitSignal chan os.Signal) {
 	go func() {
 		for {
 			select {
-			case event := <-watcher.Events:
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					if serviceName, ok := servicesWatches[event.Name]; ok {
-						log.Printf("Restarting service %v (file changed)\n", serviceName)
-						services[serviceName].Restart()
-					} else {
-						log.Println("Error : File watched is not linked to any service : ", event.Name)
+			case event := <-r.watcher.Events:
+				r.handleEvent(event)
+			case signal := <-signals:
+				if signal == syscall.SIGHUP {
+					logEvent(Event{Type: EventReloadRequested, Level: LevelInfo, Reason: signal.String(), Message: "Received SIGHUP, reloading configuration"})
+					_, err := r.reload()
+					if err != nil {
+						logEvent(Event{Type: EventReloadFailed, Level: LevelError, Reason: err.Error(), Message: fmt.Sprint("Error reloading configuration: ", err)})
 					}
+					continue
 				}
-			case signal := <-exitSignal:
-				log.Printf("Received stop signal (%v), cleaning up and exiting\n", signal)
+				logEvent(Event{Type: EventDaemonStopping, Reason: signal.String(),
+					Message: fmt.Sprintf("Received stop signal (%v), cleaning up and exiting", signal)})
+				// No event is handled while the services stop
 				done <- true
+				return
 			}
 		}
 	}()
 	<-done
 }
+
+// checkLogLoop rotates the daemon log when needed, until stop is closed
+func (r *runner) checkLogLoop(stop chan bool) {
+	ticker := time.NewTicker(logCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.daemonLog.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// newService creates a service bound to the runner
+func (r *runner) newService(config *config.Config, conf config.Service) *Service {
+	service := NewService(config.Storage, conf, r.router)
+	service.binaryCopied = func() {
+		r.metrics.binaryCopied(conf.Name)
+		r.requestGarbageCollection()
+	}
+	service.restarted = func() {
+		r.restartDependents(conf.Name)
+	}
+	return service
+}
+
+// restartDependents restarts the services depending on a service that just restarted
+func (r *runner) restartDependents(name string) {
+	if !r.startAction() {
+		return
+	}
+	defer r.actions.Done()
+
+	r.mutex.Lock()
+	dependents := r.config.Dependents(name)
+	services := r.servicesSnapshot()
+	r.mutex.Unlock()
+
+	for _, dependent := range dependents {
+		waitDependencies(services, services[dependent].currentConf())
+		logRestart(dependent, ReasonDependency, fmt.Sprintf("Restarting service %v (dependency %v restarted)", dependent, name))
+		services[dependent].restartAlone()
+	}
+}
+
+// servicesSnapshot copies the services map so it can be used without holding r.mutex
+// The caller must hold r.mutex
+func (r *runner) servicesSnapshot() map[string]*Service {
+	services := make(map[string]*Service, len(r.services))
+	for name, service := range r.services {
+		services[name] = service
+	}
+	return services
+}
+
+// waitDependencies waits for the dependencies of a service to be ready before it starts
+func waitDependencies(services map[string]*Service, conf config.Service) {
+	for _, name := range conf.DependsOn {
+		dependency, ok := services[name]
+		if !ok {
+			continue
+		}
+		if !dependency.WaitReady(dependencyReadyTimeout) {
+			logEvent(Event{Type: EventDependencyWait, Level: LevelWarn, Service: conf.Name,
+				Message: fmt.Sprintf("Service %v dependency %v is not ready, starting anyway", conf.Name, name)})
+		}
+	}
+}
+
+// stopAll stops the services in the reverse of their start order, so a service stops after its dependents
+func (r *runner) stopAll() {
+	// A reload in progress, which the control socket may have accepted while the services were starting, finishes first
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	r.mutex.Lock()
+	r.stopped = true
+
+	for name, timer := range r.pendingRestarts {
+		timer.Stop()
+		delete(r.pendingRestarts, name)
+	}
+	for name, timer := range r.pendingBuilds {
+		timer.Stop()
+		delete(r.pendingBuilds, name)
+	}
+	r.mutex.Unlock()
+
+	// Restarts already running finish first, the ones starting now see the daemon stopped
+	r.actions.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	order := r.config.StartOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		service := r.services[order[i]]
+		service.cancelRestart(false)
+		if service.IsRunning() {
+			service.Stop()
+		} else {
+			service.release()
+		}
+	}
+}
+
+func (r *runner) handleEvent(event fsnotify.Event) {
+	if !r.startAction() {
+		return
+	}
+	defer r.actions.Done()
+
+	r.mutex.Lock()
+	binaryService, isBinary := r.servicesWatches[event.Name]
+	service := r.services[binaryService]
+
+	var filesServices, buildServices []string
+	if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+		for name, matcher := range r.buildWatches {
+			if matcher.Match(event.Name) {
+				buildServices = append(buildServices, name)
+			}
+		}
+		for name, matcher := range r.filesWatches {
+			if matcher.Match(event.Name) && !(isBinary && name == binaryService) {
+				filesServices = append(filesServices, name)
+			}
+		}
+	}
+
+	// Directories created inside a recursive watch must be watched too
+	if info, err := os.Stat(event.Name); err == nil && info.IsDir() && event.Op&fsnotify.Create == fsnotify.Create {
+		for _, matchers := range []map[string]pathMatcher{r.filesWatches, r.buildWatches} {
+			for _, matcher := range matchers {
+				if matcher.watchesRecursively(event.Name) {
+					for _, directory := range matcher.walk(event.Name) {
+						r.watchedDirs[directory] = true
+						r.watcher.Add(directory)
+					}
+				}
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	concerned := make(map[string]bool)
+	for _, name := range append(append([]string(nil), filesServices...), buildServices...) {
+		concerned[name] = true
+	}
+	if isBinary {
+		concerned[binaryService] = true
+	}
+	r.metrics.watcherEvent(concerned)
+
+	if isBinary && event.Op&fsnotify.Write == fsnotify.Write {
+		changed, err := service.BinaryChanged()
+		if err != nil {
+			logMessage(LevelError, binaryService, fmt.Sprintf("Cannot read binary of service %v: %v", binaryService, err))
+		} else if !changed {
+			logEvent(Event{Type: EventRestartSkipped, Service: binaryService, Reason: ReasonBinaryChanged,
+				Message: fmt.Sprintf("Service %v binary unchanged, restart skipped", binaryService)})
+		} else {
+			logEvent(Event{Type: EventBinaryChanged, Service: binaryService,
+				Message: fmt.Sprintf("Service %v binary changed: %v", binaryService, event.Name)})
+			// Restarting waits for the dependents and handoffs, the loop keeps handling signals meanwhile
+			r.later(r.pendingRestarts, binaryService, func(service *Service) {
+				logRestart(binaryService, ReasonBinaryChanged, fmt.Sprintf("Restarting service %v (file changed)", binaryService))
+				service.Restart()
+			})
+		}
+	}
+
+	for _, name := range buildServices {
+		scheduled := r.later(r.pendingBuilds, name, func(service *Service) {
+			service.Rebuild()
+		})
+		if scheduled {
+			logEvent(Event{Type: EventSourceChanged, Level: LevelInfo, Service: name,
+				Message: fmt.Sprintf("Service %v source changed: %v", name, event.Name)})
+		}
+	}
+	for _, name := range filesServices {
+		scheduled := r.later(r.pendingRestarts, name, func(service *Service) {
+			logRestart(name, ReasonFilesChanged, fmt.Sprintf("Restarting service %v (watched files changed)", name))
+			service.Restart()
+		})
+		if scheduled {
+			logEvent(Event{Type: EventFilesChanged, Level: LevelInfo, Service: name,
+				Message: fmt.Sprintf("Service %v watched file changed: %v", name, event.Name)})
+		}
+	}
+}
+
+// later runs an action on a service once its watched files stopped changing
+// It returns false if the action was already scheduled
+func (r *runner) later(timers map[string]*time.Timer, name string, action func(service *Service)) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if timer, ok := timers[name]; ok {
+		timer.Reset(watchRestartDelay)
+		return false
+	}
+
+	timers[name] = time.AfterFunc(watchRestartDelay, func() {
+		if !r.startAction() {
+			return
+		}
+		defer r.actions.Done()
+
+		r.mutex.Lock()
+		delete(timers, name)
+		service, ok := r.services[name]
+		r.mutex.Unlock()
+
+		if ok {
+			action(service)
+		}
+	})
+	return true
+}
+
+// startAction registers an action on the services, it returns false once they are stopped for good
+// The caller must call r.actions.Done when the action is over
+func (r *runner) startAction() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.actions.Add(1)
+	return true
+}
+
+// updateWatches makes the watcher follow the binaries of the services restarting on change
+// and the files watched by services
+// The caller must hold r.mutex
+func (r *runner) updateWatches() {
+	watches := make(map[string]string)
+	filesWatches := make(map[string]pathMatcher)
+	buildWatches := make(map[string]pathMatcher)
+	watchedDirs := make(map[string]bool)
+	for _, service := range r.config.Services {
+		if service.Restart.OnChange {
+			watches[service.BinaryPath] = service.Name
+		}
+		if len(service.Watch.Paths) > 0 {
+			matcher := newPathMatcher(service.Watch.Paths, service.Watch.Ignore)
+			filesWatches[service.Name] = matcher
+			for _, directory := range matcher.directories() {
+				watchedDirs[directory] = true
+			}
+		}
+		if service.Build.Command != "" {
+			matcher := newPathMatcher(service.Build.Watch, service.Build.Ignore)
+			buildWatches[service.Name] = matcher
+			for _, directory := range matcher.directories() {
+				watchedDirs[directory] = true
+			}
+		}
+	}
+
+	for path := range r.servicesWatches {
+		if _, ok := watches[path]; !ok {
+			r.watcher.Remove(path)
+		}
+	}
+	for path := range watches {
+		if _, ok := r.servicesWatches[path]; !ok {
+			r.watcher.Add(path)
+		}
+	}
+	for directory := range r.watchedDirs {
+		if !watchedDirs[directory] {
+			r.watcher.Remove(directory)
+		}
+	}
+	for directory := range watchedDirs {
+		if !r.watchedDirs[directory] {
+			r.watcher.Add(directory)
+		}
+	}
+
+	r.servicesWatches = watches
+	r.filesWatches = filesWatches
+	r.buildWatches = buildWatches
+	r.watchedDirs = watchedDirs
+}
@@ -0,0 +1,241 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Types of the lifecycle events
+const (
+	EventDaemonStarted    = "daemon_started"
+	EventDaemonStopping   = "daemon_stopping"
+	EventReloadRequested  = "reload_requested"
+	EventReloadFailed     = "reload_failed"
+	EventConfigReloaded   = "config_reloaded"
+	EventServiceAdded     = "service_added"
+	EventServiceRemoved   = "service_removed"
+	EventStarting         = "starting"
+	EventStarted          = "started"
+	EventStartFailed      = "start_failed"
+	EventStopping         = "stopping"
+	EventKilled           = "killed"
+	EventSurvivors        = "survivors"
+	EventExited           = "exited"
+	EventRestarting       = "restarting"
+	EventRestarted        = "restarted"
+	EventRestartScheduled = "restart_scheduled"
+	EventRestartSkipped   = "restart_skipped"
+	EventDependencyWait   = "dependency_not_ready"
+	EventCrashLoop        = "crash_loop"
+	EventRollback         = "rollback"
+	EventBinaryChanged    = "binary_changed"
+	EventSourceChanged    = "source_changed"
+	EventFilesChanged     = "files_changed"
+	EventHealthChanged    = "health_changed"
+	EventBuildStarted     = "build_started"
+	EventBuildSucceeded   = "build_succeeded"
+	EventBuildFailed      = "build_failed"
+	EventBuildOutput      = "build_output"
+	// A line written by a service to the daemon log
+	EventOutput = "output"
+	// Any other message of the daemon
+	EventLog = "log"
+)
+
+// Reasons of the restarts
+const (
+	ReasonBinaryChanged = "binary_changed"
+	ReasonFilesChanged  = "files_changed"
+	ReasonBuild         = "build"
+	ReasonConfigChanged = "config_changed"
+	ReasonRequested     = "requested"
+	ReasonDependency    = "dependency"
+	ReasonUnhealthy     = "unhealthy"
+	ReasonCrashed       = "crashed"
+	ReasonExited        = "exited"
+)
+
+// Event is a lifecycle transition of the daemon or of a service
+// It is logged as its message, or as a JSON document with log_format = "json"
+type Event struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	Type     string    `json:"event"`
+	Service  string    `json:"service,omitempty"`
+	Pid      int       `json:"pid,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Binary   string    `json:"binary,omitempty"`
+	Health   string    `json:"health,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	Message  string    `json:"message"`
+}
+
+var eventLog struct {
+	mutex     sync.Mutex
+	json      bool
+	observers map[int]func(event Event)
+	lastID    int
+}
+
+// observeEvents calls the observer with every event until the returned function is called
+// Observers are called by the goroutine logging the event, they must not block
+func observeEvents(observer func(event Event)) func() {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+
+	if eventLog.observers == nil {
+		eventLog.observers = make(map[int]func(event Event))
+	}
+	eventLog.lastID++
+	id := eventLog.lastID
+	eventLog.observers[id] = observer
+
+	return func() {
+		eventLog.mutex.Lock()
+		delete(eventLog.observers, id)
+		eventLog.mutex.Unlock()
+	}
+}
+
+// setLogFormat switches the daemon log between sentences and JSON documents
+// In JSON mode, the messages logged with the log package are wrapped into events too
+func setLogFormat(format string) {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+
+	eventLog.json = format == "json"
+	if eventLog.json {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	} else {
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func logEvent(event Event) {
+	if event.Level == "" {
+		event.Level = LevelInfo
+	}
+	event.Time = time.Now()
+
+	eventLog.mutex.Lock()
+	jsonFormat := eventLog.json
+	observers := make([]func(event Event), 0, len(eventLog.observers))
+	for _, observer := range eventLog.observers {
+		observers = append(observers, observer)
+	}
+	eventLog.mutex.Unlock()
+
+	for _, observer := range observers {
+		observer(event)
+	}
+
+	if !jsonFormat {
+		if event.Type == EventOutput {
+			log.Printf("%s | %s\n", event.Service, event.Message)
+		} else {
+			log.Println(event.Message)
+		}
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	os.Stderr.Write(append(data, '\n'))
+}
+
+// logMessage logs a message of the daemon that is not a lifecycle transition
+func logMessage(level string, service string, message string) {
+	logEvent(Event{Type: EventLog, Level: level, Service: service, Message: message})
+}
+
+// logRestart logs the restart of a service, the message explains the reason
+func logRestart(service string, reason string, message string) {
+	logEvent(Event{Type: EventRestarting, Service: service, Reason: reason, Message: message})
+}
+
+// restartReason tells why a service that exited on its own is restarted
+func restartReason(exitCode int) string {
+	if exitCode != 0 {
+		return ReasonCrashed
+	}
+	return ReasonExited
+}
+
+// jsonLogWriter turns each message of the log package into a JSON event
+// The daemon logs its own messages with logEvent, only the messages of the libraries come here
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(data []byte) (int, error) {
+	message := strings.TrimSuffix(string(data), "\n")
+	encoded, err := json.Marshal(Event{Time: time.Now(), Level: LevelInfo, Type: EventLog, Message: message})
+	if err != nil {
+		return 0, err
+	}
+	_, err = os.Stderr.Write(append(encoded, '\n'))
+	return len(data), err
+}
+
+// events sends the lifecycle events of the services until the client leaves
+// The output and log events are only sent when their type is requested
+func (r *runner) events(args json.RawMessage, send func(result interface{}) error, done chan bool) error {
+	var eventsArgs EventsArgs
+	err := json.Unmarshal(args, &eventsArgs)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %s", err)
+	}
+
+	services := make(map[string]bool)
+	for _, name := range eventsArgs.Services {
+		_, err := r.service(name)
+		if err != nil {
+			return err
+		}
+		services[name] = true
+	}
+	types := make(map[string]bool)
+	for _, eventType := range eventsArgs.Types {
+		types[eventType] = true
+	}
+
+	received := make(chan Event, 256)
+	defer observeEvents(func(event Event) {
+		if len(types) == 0 && (event.Type == EventOutput || event.Type == EventLog) ||
+			len(types) > 0 && !types[event.Type] ||
+			len(services) > 0 && !services[event.Service] {
+			return
+		}
+		select {
+		case received <- event:
+		default:
+			// The client is too slow, it misses the event rather than blocking the daemon
+		}
+	})()
+
+	for {
+		select {
+		case event := <-received:
+			err = send(event)
+			if err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Binaries younger than this are never considered orphans, they may be in the middle of a copy
+const gcOrphanGracePeriod = time.Minute
+
+type gcCandidate struct {
+	service *Service
+	file    string
+	size    int64
+	time    time.Time
+}
+
+// collectGarbageLoop runs the garbage collection each time it is requested, until stop is closed
+func (r *runner) collectGarbageLoop(stop chan bool) {
+	for {
+		select {
+		case <-r.gcRequests:
+			r.collectGarbage()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// requestGarbageCollection schedules a garbage collection without waiting for it
+func (r *runner) requestGarbageCollection() {
+	select {
+	case r.gcRequests <- true:
+	default:
+		// One is already pending
+	}
+}
+
+// collectGarbage removes the copied binaries that are not needed anymore:
+// the ones of configured services missing from their history, the ones older than max_binaries_age
+// and the oldest ones until the folder is smaller than max_binaries_size
+// The binary currently used by a service is always kept, and files of unknown services are left untouched
+func (r *runner) collectGarbage() GCResult {
+	r.gcMutex.Lock()
+	defer r.gcMutex.Unlock()
+
+	r.mutex.Lock()
+	storage := r.config.Storage
+	services := make([]*Service, 0, len(r.services))
+	for _, name := range r.servicesOrder {
+		services = append(services, r.services[name])
+	}
+	r.mutex.Unlock()
+
+	var result GCResult
+
+	entries, err := os.ReadDir(storage.Binaries)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprint("Error listing binaries for garbage collection: ", err))
+		return result
+	}
+
+	now := time.Now()
+	var total int64
+	var candidates []gcCandidate
+	for _, service := range services {
+		current, versions := service.binaries()
+		indexed := make(map[string]bool, len(versions))
+
+		for _, binary := range versions {
+			indexed[binary.File] = true
+			info, err := os.Stat(path.Clean(storage.Binaries + "/" + binary.File))
+			if err != nil {
+				continue
+			}
+			total += info.Size()
+			if binary.File != current {
+				candidates = append(candidates, gcCandidate{service, binary.File, info.Size(), binary.Time})
+			}
+		}
+
+		for _, entry := range entries {
+			if !isServiceBinary(service.name, entry.Name()) || indexed[entry.Name()] || entry.Name() == current {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || now.Sub(info.ModTime()) < gcOrphanGracePeriod {
+				continue
+			}
+			r.removeBinary(storage.Binaries, gcCandidate{nil, entry.Name(), info.Size(), info.ModTime()}, &result)
+		}
+	}
+
+	// Oldest first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].time.Before(candidates[j].time)
+	})
+
+	maxAge := time.Duration(storage.MaxBinariesAge) * time.Hour
+	maxSize := int64(storage.MaxBinariesSize) * 1024 * 1024
+	for _, candidate := range candidates {
+		tooOld := maxAge > 0 && now.Sub(candidate.time) > maxAge
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			continue
+		}
+		if r.removeBinary(storage.Binaries, candidate, &result) {
+			total -= candidate.size
+		}
+	}
+
+	if len(result.Removed) > 0 {
+		logMessage(LevelInfo, "", fmt.Sprintf("Garbage collection removed %d binaries (%d bytes)", len(result.Removed), result.Reclaimed))
+	}
+	return result
+}
+
+func (r *runner) removeBinary(folder string, candidate gcCandidate, result *GCResult) bool {
+	if candidate.service != nil && !candidate.service.forget(candidate.file) {
+		// The service started using it in the meantime
+		return false
+	}
+
+	err := os.Remove(path.Clean(folder + "/" + candidate.file))
+	if err != nil && !os.IsNotExist(err) {
+		logMessage(LevelError, "", fmt.Sprintf("Cannot remove binary %v: %v", candidate.file, err))
+		return false
+	}
+
+	result.Removed = append(result.Removed, candidate.file)
+	result.Reclaimed += candidate.size
+	return true
+}
+
+// isServiceBinary checks if the file name was generated by copyBinary for this service
+func isServiceBinary(service string, file string) bool {
+	if !strings.HasPrefix(file, service+"-") {
+		return false
+	}
+	suffix := file[len(service)+1:]
+	_, err := hex.DecodeString(suffix)
+	return len(suffix) == 8 && err == nil
+}
@@ -0,0 +1,289 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arnopensource/devo/config"
+)
+
+// Argument running devo as a shim between the daemon and a service receiving sockets
+// LISTEN_PID must be the pid of the service, only known once it is forked, and exec keeps the pid
+const listenShimArg = "__listen_exec"
+
+// RunListenShim executes the service when devo runs as its shim, and returns otherwise
+func RunListenShim() {
+	if len(os.Args) < 4 || os.Args[1] != listenShimArg {
+		return
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	err := syscall.Exec(os.Args[2], os.Args[3:], os.Environ())
+	fmt.Fprintln(os.Stderr, "Cannot execute service:", err)
+	os.Exit(127)
+}
+
+// passListeners returns the command running the service through the shim, with the sockets of the service as fds 3 and up,
+// and the socket where it notifies it is ready as NOTIFY_SOCKET
+// The caller must hold s.mutex
+func (s *Service) passListeners(command *exec.Cmd, args []string, notify *notifySocket) (*exec.Cmd, error) {
+	if command.Err != nil {
+		return nil, command.Err
+	}
+	shim, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the devo executable: %s", err)
+	}
+
+	shimCommand := exec.Command(shim, append([]string{listenShimArg, command.Path}, args...)...)
+	shimCommand.Dir = command.Dir
+	shimCommand.SysProcAttr = command.SysProcAttr
+	shimCommand.Env = append(command.Env, fmt.Sprintf("LISTEN_FDS=%d", len(s.listeners)), "NOTIFY_SOCKET="+notify.path)
+	shimCommand.ExtraFiles = s.listeners
+	return shimCommand, nil
+}
+
+// notifySocket receives the sd_notify messages of a process on shared sockets
+// Probing the sockets could reach the previous process, so the new one tells it is ready with READY=1
+type notifySocket struct {
+	conn  *net.UnixConn
+	path  string
+	once  sync.Once
+	ready chan bool
+}
+
+// Number of notify sockets opened, naming the next one
+var notifySockets uint32
+
+// openNotifySocket opens a datagram socket for one process, next to the socket of the daemon
+func openNotifySocket(directory string) (*notifySocket, error) {
+	socketPath := path.Join(directory, fmt.Sprintf("notify-%d-%d.sock", os.Getpid(), atomic.AddUint32(&notifySockets, 1)))
+	// A socket left by a previous run
+	os.Remove(socketPath)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open notify socket: %s", err)
+	}
+	n := &notifySocket{conn: conn, path: socketPath, ready: make(chan bool)}
+	go n.receive()
+	return n, nil
+}
+
+// receive reads the messages until the socket is closed, messages other than READY=1 are ignored
+func (n *notifySocket) receive() {
+	buffer := make([]byte, 4096)
+	for {
+		size, err := n.conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(buffer[:size]), "\n") {
+			if line == "READY=1" {
+				n.once.Do(func() { close(n.ready) })
+			}
+		}
+	}
+}
+
+func (n *notifySocket) Close() {
+	n.conn.Close()
+	os.Remove(n.path)
+}
+
+// openListeners opens the sockets of the service, they stay open across restarts so no connection is refused
+// Sockets no longer in the configuration are closed
+// The caller must hold s.mutex
+func (s *Service) openListeners() error {
+	if equalStrings(s.listenAddresses, s.conf.Handoff.Listen) {
+		return nil
+	}
+	s.closeListeners()
+
+	for _, address := range s.conf.Handoff.Listen {
+		network, listenAddress := config.ListenAddress(address)
+		if network == "unix" {
+			// A socket left by a previous run
+			os.Remove(listenAddress)
+		}
+		listener, err := net.Listen(network, listenAddress)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("cannot listen on %s: %s", address, err)
+		}
+
+		var file *os.File
+		switch listener := listener.(type) {
+		case *net.TCPListener:
+			file, err = listener.File()
+		case *net.UnixListener:
+			// The socket file is removed with the listeners, not when this copy is closed
+			listener.SetUnlinkOnClose(false)
+			file, err = listener.File()
+		default:
+			err = errors.New("unsupported listener")
+		}
+		listener.Close()
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("cannot listen on %s: %s", address, err)
+		}
+		s.listeners = append(s.listeners, file)
+		s.listenAddresses = append(s.listenAddresses, address)
+	}
+	return nil
+}
+
+// closeListeners closes the sockets of the service
+// The caller must hold s.mutex
+func (s *Service) closeListeners() {
+	for i, file := range s.listeners {
+		file.Close()
+		if network, listenAddress := config.ListenAddress(s.listenAddresses[i]); network == "unix" {
+			os.Remove(listenAddress)
+		}
+	}
+	s.listeners = nil
+	s.listenAddresses = nil
+}
+
+// handsOff reports whether restarts overlap the new process with the current one
+func (s *Service) handsOff() bool {
+	return len(s.conf.Handoff.Listen) > 0 || s.conf.Handoff.SwapPort != 0
+}
+
+// handoff restarts the service by starting the new process on the same sockets, or on the other port of a blue/green swap,
+// then stopping the previous one once the new one is ready
+// The previous process keeps running if the new one does not start or is not ready in time
+// keepBinary runs the current copy of the binary instead of copying the binary again
+// The caller must hold s.mutex
+func (s *Service) handoff(keepBinary bool) error {
+	s.stateMutex.Lock()
+	binaryName, version := s.binaryName, s.version
+	previousPort, port := s.port, s.conf.Port
+	if s.conf.Handoff.SwapPort != 0 && previousPort == s.conf.Port {
+		port = s.conf.Handoff.SwapPort
+	}
+	s.stateMutex.Unlock()
+	previousPid := s.command.Process.Pid
+	previousExited := s.exitedChannel
+
+	message := fmt.Sprintf("Starting service %v next to pid %v", s.name, previousPid)
+	if port != previousPort {
+		message = fmt.Sprintf("Starting service %v on port %v next to pid %v", s.name, port, previousPid)
+	}
+	logEvent(Event{Type: EventStarting, Service: s.name, Message: message})
+
+	var p *process
+	var err error
+	if !keepBinary {
+		err = s.copyBinary()
+	}
+	if err == nil {
+		p, err = s.spawn(port)
+	}
+	if err == nil {
+		go s.wait(p)
+		err = s.waitHandoffReady(p)
+	}
+	if err == nil && !s.adopt(p) {
+		err = s.processExited(p)
+	}
+	if err != nil {
+		if p != nil && !s.ended(p) {
+			s.terminate(p.command.Process.Pid, p.exited)
+		}
+		s.stateMutex.Lock()
+		s.binaryName, s.version = binaryName, version
+		s.stateMutex.Unlock()
+		logEvent(Event{Type: EventStartFailed, Level: LevelError, Service: s.name, Reason: err.Error(),
+			Message: fmt.Sprintf("Cannot hand off service %v, pid %v keeps running: %v", s.name, previousPid, err)})
+		return err
+	}
+	// The previous process may have crashed meanwhile
+	s.cancelRestart(false)
+
+	logEvent(Event{Type: EventStopping, Service: s.name, Pid: previousPid, Message: fmt.Sprintf("Stopping previous process of service %v", s.name)})
+	err = s.terminate(previousPid, previousExited)
+	if err != nil && err != syscall.ESRCH {
+		logMessage(LevelError, s.name, fmt.Sprintf("Error stopping previous process of service %v: %v", s.name, err))
+	}
+	return nil
+}
+
+// waitHandoffReady waits for a process started by a handoff to stay up ready_delay seconds, then to notify it is ready on
+// shared sockets, or to pass its health check on the port of a blue/green swap
+// Without a health check, the process must accept connections on its port
+func (s *Service) waitHandoffReady(p *process) error {
+	select {
+	case <-p.exited:
+		return s.processExited(p)
+	case <-time.After(time.Duration(s.conf.Handoff.ReadyDelay) * time.Second):
+	}
+
+	if p.notify != nil {
+		select {
+		case <-p.notify.ready:
+			return nil
+		case <-p.exited:
+			return s.processExited(p)
+		case <-time.After(time.Duration(s.conf.Handoff.ReadyTimeout) * time.Second):
+			return fmt.Errorf("READY=1 not notified after %v seconds", s.conf.Handoff.ReadyTimeout)
+		}
+	}
+
+	conf := p.conf
+	if conf.Health.Type == "" {
+		conf.Health.Type = "tcp"
+		conf.Health.Port = conf.Port
+		conf.Health.Timeout = 2
+	}
+	deadline := time.Now().Add(time.Duration(s.conf.Handoff.ReadyTimeout) * time.Second)
+	for {
+		err := probe(conf, p.replacer)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not healthy after %v seconds: %s", s.conf.Handoff.ReadyTimeout, err)
+		}
+		select {
+		case <-p.exited:
+			return s.processExited(p)
+		case <-time.After(healthStartingInterval):
+		}
+	}
+}
+
+func (s *Service) ended(p *process) bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return p.ended
+}
+
+// processExited returns the error of a process that exited before being ready
+func (s *Service) processExited(p *process) error {
+	<-p.exited
+	return fmt.Errorf("exited with exit code %v", p.command.ProcessState.ExitCode())
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/arnopensource/devo/config"
+)
+
+type HealthState string
+
+const (
+	HealthStarting  HealthState = "starting"
+	HealthHealthy   HealthState = "healthy"
+	HealthUnhealthy HealthState = "unhealthy"
+)
+
+// Probe interval while the service is starting, so dependents wait as little as possible
+const healthStartingInterval = 250 * time.Millisecond
+
+// checkHealth probes the service until stop is closed
+// A starting service has interval * threshold to become healthy, then threshold consecutive failures make it unhealthy
+func (s *Service) checkHealth(service config.Service, placeholders *strings.Replacer, command *exec.Cmd, stop chan bool) {
+	conf := service.Health
+	interval := time.Duration(conf.Interval) * time.Second
+	startDeadline := time.Now().Add(interval * time.Duration(conf.Threshold))
+
+	s.setHealth(HealthStarting)
+	timer := time.NewTimer(healthStartingInterval)
+	defer timer.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		err := probe(service, placeholders)
+		select {
+		case <-stop:
+			// The process exited during the probe
+			return
+		default:
+		}
+		if !s.current(command) {
+			// Replaced by a handoff
+			return
+		}
+		health := s.Health()
+
+		switch {
+		case err == nil:
+			failures = 0
+			if health != HealthHealthy {
+				logEvent(Event{Type: EventHealthChanged, Service: service.Name, Health: string(HealthHealthy),
+					Message: fmt.Sprintf("Service %v is healthy", service.Name)})
+				s.setHealth(HealthHealthy)
+			}
+		case health == HealthStarting && time.Now().Before(startDeadline):
+			// Still booting
+		default:
+			failures++
+			if health == HealthStarting || failures >= conf.Threshold && health != HealthUnhealthy {
+				logEvent(Event{Type: EventHealthChanged, Level: LevelWarn, Service: service.Name, Health: string(HealthUnhealthy), Reason: err.Error(),
+					Message: fmt.Sprintf("Service %v is unhealthy: %v", service.Name, err)})
+				s.setHealth(HealthUnhealthy)
+
+				if conf.Restart {
+					logRestart(service.Name, ReasonUnhealthy, fmt.Sprintf("Restarting service %v (unhealthy)", service.Name))
+					go s.restartUnhealthy(command)
+					return
+				}
+			}
+		}
+
+		if s.Health() == HealthStarting {
+			timer.Reset(healthStartingInterval)
+		} else {
+			timer.Reset(interval)
+		}
+	}
+}
+
+// current reports whether the command is the current process of the service
+func (s *Service) current(command *exec.Cmd) bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.pid == command.Process.Pid
+}
+
+// restartUnhealthy restarts the service unless the unhealthy process was already stopped or replaced
+func (s *Service) restartUnhealthy(command *exec.Cmd) {
+	s.cancelRestart(true)
+
+	s.mutex.Lock()
+	if s.command != command || !s.IsRunning() {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.stateMutex.Lock()
+	s.restarts++
+	s.stateMutex.Unlock()
+
+	// The binary is kept, it may have been rolled back
+	err := s.restartProcess(true)
+	if err == nil {
+		s.logRestarted()
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		logMessage(LevelError, s.name, fmt.Sprintf("Error restarting unhealthy service %v: %v", s.name, err))
+		return
+	}
+	s.notifyRestarted()
+}
+
+func probe(service config.Service, placeholders *strings.Replacer) error {
+	conf := service.Health
+	timeout := time.Duration(conf.Timeout) * time.Second
+
+	switch conf.Type {
+	case "http":
+		client := http.Client{Timeout: timeout}
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", conf.Port, conf.Path))
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 400 {
+			return errors.New("HTTP status " + response.Status)
+		}
+		return nil
+
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", conf.Port), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		args, err := commandArgs(conf.Command, nil, service.Env, placeholders)
+		if err != nil {
+			return err
+		}
+		command := exec.CommandContext(ctx, args[0], args[1:]...)
+		command.Dir = service.Dir
+		command.Env = os.Environ()
+		for key, value := range service.Env {
+			command.Env = append(command.Env, fmt.Sprintf("%v=%v", key, value))
+		}
+		output, err := command.CombinedOutput()
+		if err != nil && len(bytes.TrimSpace(output)) > 0 {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Service) Health() HealthState {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.health
+}
+
+func (s *Service) setHealth(health HealthState) {
+	s.stateMutex.Lock()
+	s.health = health
+	s.stateMutex.Unlock()
+}
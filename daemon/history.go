@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// BinaryVersion is a copy of a service binary kept in the binaries storage folder
+type BinaryVersion struct {
+	Version int       `json:"version"`
+	File    string    `json:"file"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+}
+
+// binaryHistory is the index of the binaries copied for a service, oldest first
+// It is saved next to the binaries so it survives daemon restarts
+type binaryHistory struct {
+	file     string
+	Versions []BinaryVersion `json:"versions"`
+}
+
+func historyFile(binaryStorageFolder string, service string) string {
+	return path.Clean(binaryStorageFolder + "/" + service + ".history.json")
+}
+
+func loadHistory(binaryStorageFolder string, service string) (*binaryHistory, error) {
+	history := &binaryHistory{file: historyFile(binaryStorageFolder, service)}
+
+	data, err := os.ReadFile(history.file)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return history, fmt.Errorf("unable to read binary history: %s", err)
+	}
+
+	err = json.Unmarshal(data, history)
+	if err != nil {
+		return history, fmt.Errorf("unable to parse binary history %s: %s", history.file, err)
+	}
+	return history, nil
+}
+
+func (h *binaryHistory) save() error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so the index is never left half written
+	err = os.WriteFile(h.file+".tmp", data, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write binary history: %s", err)
+	}
+	return os.Rename(h.file+".tmp", h.file)
+}
+
+// add appends a binary to the history and keeps only the last versions
+// It returns the versions that were dropped from the history
+func (h *binaryHistory) add(binary BinaryVersion, keep int) []BinaryVersion {
+	binary.Version = 1
+	if len(h.Versions) > 0 {
+		binary.Version = h.Versions[len(h.Versions)-1].Version + 1
+	}
+	h.Versions = append(h.Versions, binary)
+
+	if len(h.Versions) <= keep {
+		return nil
+	}
+	dropped := append([]BinaryVersion(nil), h.Versions[:len(h.Versions)-keep]...)
+	h.Versions = append([]BinaryVersion(nil), h.Versions[len(h.Versions)-keep:]...)
+	return dropped
+}
+
+func (h *binaryHistory) get(version int) (BinaryVersion, bool) {
+	for _, binary := range h.Versions {
+		if binary.Version == version {
+			return binary, true
+		}
+	}
+	return BinaryVersion{}, false
+}
+
+// previous returns the most recent version older than the given one
+func (h *binaryHistory) previous(version int) (BinaryVersion, bool) {
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		if h.Versions[i].Version < version {
+			return h.Versions[i], true
+		}
+	}
+	return BinaryVersion{}, false
+}
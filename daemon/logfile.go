@@ -0,0 +1,320 @@
+package daemon
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arnopensource/devo/config"
+)
+
+// Interval between two checks of the daemon log, which is written directly by the log package and the services
+const logCheckInterval = time.Minute
+
+// logFile is a log file following a file name template with date placeholders
+// It is reopened when the date in the name changes, and rotated when it grows past maxSize:
+// the file is renamed to name.1, the previous name.1 to name.2 and so on, keeping the last files only
+// Files named after a previous date are only removed past the last keep dates, with their rotations
+type logFile struct {
+	template string
+	// Called with each new file, the daemon log redirects its output there
+	opened func(file *os.File) error
+
+	mutex    sync.Mutex
+	maxSize  int64
+	keep     int
+	compress bool
+	name     string
+	file     *os.File
+	size     int64
+
+	// Rotated files are shifted, compressed and pruned in the background, so writes never wait for them
+	// The tasks are guarded by l.mutex, and run in order by one goroutine at a time holding filesMutex
+	tasks      []func()
+	filesMutex sync.Mutex
+}
+
+// Suffix of the size rotations of a log file
+var rotationSuffix = regexp.MustCompile(`(\.\d+)?(\.gz)?$`)
+
+func openLogFile(template string, storage config.Storage, opened func(file *os.File) error) (*logFile, error) {
+	l := &logFile{template: template, opened: opened}
+	l.setRotation(storage)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	err := l.open(config.UseDateInFilename(template))
+	if err != nil {
+		return nil, err
+	}
+	// The date may have changed while the daemon was stopped
+	name, keep := l.name, l.keep
+	l.background(func() { l.pruneDates(name, keep) })
+	return l, nil
+}
+
+func (l *logFile) setRotation(storage config.Storage) {
+	l.mutex.Lock()
+	l.maxSize = int64(storage.LogMaxSize) * 1024 * 1024
+	l.keep = storage.LogKeep
+	l.compress = storage.LogCompress
+	l.mutex.Unlock()
+}
+
+func (l *logFile) Write(data []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rotateIfNeeded(int64(len(data)))
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return n, err
+}
+
+// check rotates the file if needed, for the files written without Write
+func (l *logFile) check() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return
+	}
+	if info, err := l.file.Stat(); err == nil {
+		l.size = info.Size()
+	}
+	l.rotateIfNeeded(0)
+}
+
+func (l *logFile) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotateIfNeeded switches to a new file when the date in the name changed or when writing would exceed the maximum size
+// The caller must hold l.mutex
+func (l *logFile) rotateIfNeeded(writing int64) {
+	if l.file == nil {
+		return
+	}
+
+	name := config.UseDateInFilename(l.template)
+	if name != l.name {
+		previous := l.name
+		err := l.open(name)
+		if err != nil {
+			logMessage(LevelError, "", fmt.Sprintf("Cannot open log file %v: %v", name, err))
+			return
+		}
+		compress, keep := l.compress, l.keep
+		l.background(func() {
+			if compress {
+				compressFile(previous)
+			}
+			l.pruneDates(name, keep)
+		})
+		return
+	}
+
+	if l.maxSize <= 0 || l.size == 0 || l.size+writing <= l.maxSize {
+		return
+	}
+
+	// The file is moved aside at once, it becomes name.1 once the previous rotations are shifted
+	pending := fmt.Sprintf("%s.rotating-%d", name, time.Now().UnixNano())
+	os.Rename(name, pending)
+	err := l.open(name)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprintf("Cannot open log file %v: %v", name, err))
+		return
+	}
+	compress, keep := l.compress, l.keep
+	l.background(func() {
+		shiftRotations(name, pending, keep)
+		if compress && keep > 0 {
+			compressFile(name + ".1")
+		}
+	})
+}
+
+// background queues a task on the files, run without holding l.mutex
+// The caller must hold l.mutex
+func (l *logFile) background(task func()) {
+	l.tasks = append(l.tasks, task)
+	go l.runTasks()
+}
+
+// runTasks runs the queued tasks in order, the goroutines started meanwhile find nothing left to run
+func (l *logFile) runTasks() {
+	l.filesMutex.Lock()
+	defer l.filesMutex.Unlock()
+
+	for {
+		l.mutex.Lock()
+		if len(l.tasks) == 0 {
+			l.mutex.Unlock()
+			return
+		}
+		task := l.tasks[0]
+		l.tasks = l.tasks[1:]
+		l.mutex.Unlock()
+
+		task()
+	}
+}
+
+// shiftRotations renames name.1 to name.2 and so on, then the rotated file to name.1, the oldest ones are dropped
+func shiftRotations(name string, rotated string, keep int) {
+	for i := keep; i >= 1; i-- {
+		for _, suffix := range []string{"", ".gz"} {
+			older := fmt.Sprintf("%s.%d%s", name, i, suffix)
+			if i == keep {
+				os.Remove(older)
+			} else {
+				os.Rename(older, fmt.Sprintf("%s.%d%s", name, i+1, suffix))
+			}
+		}
+	}
+	if keep <= 0 {
+		os.Remove(rotated)
+	} else {
+		os.Rename(rotated, name+".1")
+	}
+}
+
+// pruneDates removes the files named after the previous dates, with their rotations, but the ones of the last keep dates
+func (l *logFile) pruneDates(current string, keep int) {
+	if current == l.template {
+		return
+	}
+	directory := path.Dir(current)
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprintf("Cannot list log files in %v: %v", directory, err))
+		return
+	}
+
+	// Files of each date, and when the date was last written
+	files := make(map[string][]string)
+	written := make(map[string]time.Time)
+	for _, entry := range entries {
+		date := entry.Name()
+		if !config.IsDatedFilename(l.template, date) {
+			date = rotationSuffix.ReplaceAllString(date, "")
+			if !config.IsDatedFilename(l.template, date) {
+				continue
+			}
+		}
+		if date == path.Base(current) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files[date] = append(files[date], entry.Name())
+		if info.ModTime().After(written[date]) {
+			written[date] = info.ModTime()
+		}
+	}
+	if len(files) <= keep {
+		return
+	}
+
+	dates := make([]string, 0, len(files))
+	for date := range files {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return written[dates[i]].After(written[dates[j]])
+	})
+	for _, date := range dates[keep:] {
+		for _, file := range files[date] {
+			err := os.Remove(path.Join(directory, file))
+			if err != nil {
+				logMessage(LevelError, "", fmt.Sprintf("Cannot remove log file %v: %v", file, err))
+			}
+		}
+	}
+}
+
+// open switches to the file, closing the current one
+// The caller must hold l.mutex
+func (l *logFile) open(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if l.opened != nil {
+		err = l.opened(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.name = name
+	l.size = info.Size()
+	return nil
+}
+
+// compressFile replaces a rotated file with its gzipped version
+func compressFile(name string) {
+	err := gzipFile(name)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprintf("Cannot compress log file %v: %v", name, err))
+	}
+}
+
+func gzipFile(name string) error {
+	source, err := os.Open(name)
+	if os.IsNotExist(err) {
+		// Already shifted away or removed
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(destination)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
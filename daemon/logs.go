@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// logs sends the recent lines of the services, then the new ones when following them
+func (r *runner) logs(args json.RawMessage, send func(result interface{}) error, done chan bool) error {
+	var logsArgs LogsArgs
+	err := json.Unmarshal(args, &logsArgs)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %s", err)
+	}
+
+	var outputs []*serviceOutput
+	if len(logsArgs.Services) == 0 {
+		r.mutex.Lock()
+		for _, name := range r.servicesOrder {
+			outputs = append(outputs, r.services[name].output)
+		}
+		r.mutex.Unlock()
+	} else {
+		for _, name := range logsArgs.Services {
+			service, err := r.service(name)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, service.output)
+		}
+	}
+
+	selected := func(line LogLine) bool {
+		return (!logsArgs.Stderr || line.Stream == StreamStderr) &&
+			(logsArgs.Since == nil || !line.Time.Before(*logsArgs.Since))
+	}
+
+	// Followers are registered before reading the recent lines, so no line is missed in between
+	follower := make(chan LogLine, 256)
+	var lines []LogLine
+	for _, output := range outputs {
+		var recent []LogLine
+		if logsArgs.Follow {
+			recent = output.follow(follower)
+			defer output.unfollow(follower)
+		} else {
+			recent = output.recent(0)
+		}
+		for _, line := range recent {
+			if selected(line) {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	// Interleave the services
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Time.Before(lines[j].Time)
+	})
+	if logsArgs.Lines > 0 && len(lines) > logsArgs.Lines {
+		lines = lines[len(lines)-logsArgs.Lines:]
+	}
+	for _, line := range lines {
+		err = send(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !logsArgs.Follow {
+		return nil
+	}
+	for {
+		select {
+		case line := <-follower:
+			if !selected(line) {
+				continue
+			}
+			err = send(line)
+			if err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock ticks per second of the CPU times in /proc, USER_HZ is 100 on every Linux architecture
+const procClockTicks = 100
+
+// Categories of restarts exposed in the metrics
+const (
+	RestartChange = "change"
+	RestartError  = "error"
+	RestartExit   = "exit"
+	RestartManual = "manual"
+)
+
+var restartCategories = map[string]string{
+	ReasonBinaryChanged: RestartChange,
+	ReasonFilesChanged:  RestartChange,
+	ReasonBuild:         RestartChange,
+	ReasonConfigChanged: RestartChange,
+	ReasonCrashed:       RestartError,
+	ReasonUnhealthy:     RestartError,
+	ReasonExited:        RestartExit,
+	ReasonRequested:     RestartManual,
+	ReasonDependency:    RestartManual,
+}
+
+// metrics counts what cannot be read from the services when the metrics are scraped
+type metrics struct {
+	mutex         sync.Mutex
+	restarts      map[string]map[string]int
+	binaryCopies  map[string]int
+	watcherEvents map[string]int
+	watcherTotal  int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		restarts:      make(map[string]map[string]int),
+		binaryCopies:  make(map[string]int),
+		watcherEvents: make(map[string]int),
+	}
+}
+
+// observe counts the restarts from the lifecycle events
+// Automatic restarts are counted when they are scheduled
+func (m *metrics) observe(event Event) {
+	var category string
+	switch event.Type {
+	case EventRestarting, EventRestartScheduled:
+		category = restartCategories[event.Reason]
+	case EventRollback:
+		category = RestartManual
+	}
+	if category == "" {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.restarts[event.Service] == nil {
+		m.restarts[event.Service] = make(map[string]int)
+	}
+	m.restarts[event.Service][category]++
+}
+
+func (m *metrics) binaryCopied(service string) {
+	m.mutex.Lock()
+	m.binaryCopies[service]++
+	m.mutex.Unlock()
+}
+
+// watcherEvent counts a file system event, and the services it concerns
+func (m *metrics) watcherEvent(services map[string]bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.watcherTotal++
+	for service := range services {
+		m.watcherEvents[service]++
+	}
+}
+
+// serveMetrics serves the metrics in the Prometheus text format until the returned server is closed
+func (r *runner) serveMetrics(listen string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %s", listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writer.Write(r.writeMetrics())
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logMessage(LevelError, "", fmt.Sprint("Error serving metrics: ", err))
+		}
+	}()
+	return server, nil
+}
+
+func (r *runner) writeMetrics() []byte {
+	r.mutex.Lock()
+	services := make([]*Service, 0, len(r.servicesOrder))
+	for _, name := range r.servicesOrder {
+		services = append(services, r.services[name])
+	}
+	r.mutex.Unlock()
+
+	// Read before locking the counters, which the event observer locks under the locks of the services
+	statuses := make([]ServiceStatus, len(services))
+	for i, service := range services {
+		statuses[i] = service.Status()
+	}
+
+	m := r.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var out bytes.Buffer
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	value := func(name string, labels string, value interface{}) {
+		fmt.Fprintf(&out, "%s{%s} %v\n", name, labels, value)
+	}
+
+	metric("devo_service_up", "gauge", "Whether the service is running")
+	for _, status := range statuses {
+		up := 0
+		if status.State == StateRunning {
+			up = 1
+		}
+		value("devo_service_up", serviceLabel(status.Name), up)
+	}
+
+	metric("devo_service_restarts_total", "counter", "Restarts of the service by reason")
+	for _, status := range statuses {
+		for _, category := range []string{RestartChange, RestartError, RestartExit, RestartManual} {
+			value("devo_service_restarts_total", serviceLabel(status.Name)+`,reason="`+category+`"`, m.restarts[status.Name][category])
+		}
+	}
+
+	metric("devo_service_last_exit_code", "gauge", "Exit code of the last run of the service")
+	for _, status := range statuses {
+		if status.ExitCode != nil {
+			value("devo_service_last_exit_code", serviceLabel(status.Name), *status.ExitCode)
+		}
+	}
+
+	metric("devo_service_uptime_seconds", "gauge", "Time since the service started, 0 when it is not running")
+	for _, status := range statuses {
+		value("devo_service_uptime_seconds", serviceLabel(status.Name), status.Uptime)
+	}
+
+	metric("devo_service_binary_copies_total", "counter", "Binaries copied for the service")
+	for _, status := range statuses {
+		value("devo_service_binary_copies_total", serviceLabel(status.Name), m.binaryCopies[status.Name])
+	}
+
+	metric("devo_service_watcher_events_total", "counter", "File system events concerning the service")
+	for _, status := range statuses {
+		value("devo_service_watcher_events_total", serviceLabel(status.Name), m.watcherEvents[status.Name])
+	}
+
+	metric("devo_service_cpu_seconds_total", "counter", "CPU time used by the service process")
+	rss := make(map[string]int64)
+	for _, status := range statuses {
+		if status.Pid == 0 {
+			continue
+		}
+		seconds, memory, err := processUsage(status.Pid)
+		if err != nil {
+			continue
+		}
+		rss[status.Name] = memory
+		value("devo_service_cpu_seconds_total", serviceLabel(status.Name), strconv.FormatFloat(seconds, 'f', -1, 64))
+	}
+
+	metric("devo_service_memory_rss_bytes", "gauge", "Resident memory of the service process")
+	names := make([]string, 0, len(rss))
+	for name := range rss {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value("devo_service_memory_rss_bytes", serviceLabel(name), rss[name])
+	}
+
+	metric("devo_watcher_events_total", "counter", "File system events received by the daemon")
+	fmt.Fprintf(&out, "devo_watcher_events_total %d\n", m.watcherTotal)
+
+	return out.Bytes()
+}
+
+func serviceLabel(service string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(service)
+	return `service="` + escaped + `"`
+}
+
+// processUsage reads the CPU time and resident memory of a process from /proc, on Linux only
+func processUsage(pid int) (float64, int64, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	// Fields after the command name, starting with the state which is the third field of the file
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	rssPages, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return float64(utime+stime) / procClockTicks, rssPages * int64(os.Getpagesize()), nil
+}
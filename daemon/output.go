@@ -0,0 +1,263 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines longer than this are split, so a service writing without newlines cannot fill the memory
+const maxOutputLine = 16 * 1024
+
+// Number of lines logged when a service crashes
+const crashReportLines = 10
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// outputRing keeps the last lines written by a service in a fixed size buffer
+type outputRing struct {
+	lines []LogLine
+	start int
+	count int
+}
+
+func newOutputRing(size int) outputRing {
+	return outputRing{lines: make([]LogLine, size)}
+}
+
+func (r *outputRing) add(line LogLine) {
+	if len(r.lines) == 0 {
+		return
+	}
+	if r.count < len(r.lines) {
+		r.lines[(r.start+r.count)%len(r.lines)] = line
+		r.count++
+		return
+	}
+	// Full, the oldest line is overwritten
+	r.lines[r.start] = line
+	r.start = (r.start + 1) % len(r.lines)
+}
+
+// last returns the last lines, oldest first. n <= 0 returns all of them
+func (r *outputRing) last(n int) []LogLine {
+	if n <= 0 || n > r.count {
+		n = r.count
+	}
+	lines := make([]LogLine, 0, n)
+	for i := r.count - n; i < r.count; i++ {
+		lines = append(lines, r.lines[(r.start+i)%len(r.lines)])
+	}
+	return lines
+}
+
+// serviceOutput keeps the recent lines written by a service and sends the new ones to its followers
+// It lives as long as the service, across restarts
+type serviceOutput struct {
+	name string
+
+	mutex     sync.Mutex
+	ring      outputRing
+	followers map[chan LogLine]bool
+}
+
+func newServiceOutput(name string, size int) *serviceOutput {
+	return &serviceOutput{
+		name:      name,
+		ring:      newOutputRing(size),
+		followers: make(map[chan LogLine]bool),
+	}
+}
+
+// resize changes the number of lines kept, keeping the most recent ones
+func (o *serviceOutput) resize(size int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if size == len(o.ring.lines) {
+		return
+	}
+	ring := newOutputRing(size)
+	for _, line := range o.ring.last(size) {
+		ring.add(line)
+	}
+	o.ring = ring
+}
+
+func (o *serviceOutput) add(stream string, line string) {
+	logLine := LogLine{Service: o.name, Stream: stream, Time: time.Now(), Line: line}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.ring.add(logLine)
+
+	for follower := range o.followers {
+		select {
+		case follower <- logLine:
+		default:
+			// The follower is too slow, it misses the line rather than blocking the service
+		}
+	}
+}
+
+// recent returns the last n kept lines, all of them if n <= 0
+func (o *serviceOutput) recent(n int) []LogLine {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.ring.last(n)
+}
+
+// follow sends the new lines to the channel until unfollow is called
+// It returns the kept lines, so none is missed or received twice
+func (o *serviceOutput) follow(follower chan LogLine) []LogLine {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.followers[follower] = true
+	return o.ring.last(0)
+}
+
+func (o *serviceOutput) unfollow(follower chan LogLine) {
+	o.mutex.Lock()
+	delete(o.followers, follower)
+	o.mutex.Unlock()
+}
+
+// pipe returns a file for a stream of the service, copied to the destination and split into lines
+// A nil destination is the daemon log, where the lines are prefixed with the service name
+// exec.Cmd would copy to a writer itself, but then Wait also waits for the processes forked by the service
+// The caller closes the returned file once the service started, finished is called when the service and its children exit
+func (o *serviceOutput) pipe(stream string, destination io.Writer, finished func()) (*os.File, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var partial []byte
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buffer)
+			if n > 0 {
+				if destination != nil {
+					destination.Write(buffer[:n])
+				}
+				partial = append(partial, buffer[:n]...)
+				for {
+					end := bytes.IndexByte(partial, '\n')
+					if end < 0 && len(partial) < maxOutputLine {
+						break
+					} else if end < 0 {
+						end = maxOutputLine
+					}
+					o.line(stream, string(bytes.TrimSuffix(partial[:end], []byte("\r"))), destination == nil)
+					if end < len(partial) && partial[end] == '\n' {
+						end++
+					}
+					partial = partial[end:]
+				}
+				// Do not keep a large array for a small partial line
+				partial = append([]byte(nil), partial...)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if len(partial) > 0 {
+			o.line(stream, string(partial), destination == nil)
+		}
+
+		reader.Close()
+		finished()
+	}()
+	return writer, nil
+}
+
+func (o *serviceOutput) line(stream string, line string, toDaemonLog bool) {
+	o.add(stream, line)
+	if toDaemonLog {
+		logEvent(Event{Type: EventOutput, Service: o.name, Stream: stream, Message: line})
+	}
+}
+
+// reportCrash logs the last lines written by a service that crashed, since it started
+func (s *Service) reportCrash(startedAt time.Time, drained chan bool) {
+	// The last lines may still be in the pipes
+	select {
+	case <-drained:
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	var report strings.Builder
+	for _, line := range s.output.recent(crashReportLines) {
+		if line.Time.Before(startedAt) {
+			continue
+		}
+		fmt.Fprintf(&report, "  %s | %s\n", line.Stream, line.Line)
+	}
+	if report.Len() > 0 {
+		logEvent(Event{Type: EventLog, Level: LevelError, Service: s.name,
+			Message: fmt.Sprintf("Service %v crashed, last output:\n%s", s.name, strings.TrimSuffix(report.String(), "\n"))})
+	}
+}
+
+// openOutputs returns the files the service writes to, feeding its log files, or the daemon log, and its output history
+// drained is closed once everything the service wrote was read
+func (s *Service) openOutputs() (stdoutPipe *os.File, stderrPipe *os.File, drained chan bool, err error) {
+	var stdout, stderr io.Writer
+	var logFiles []*logFile
+	if s.conf.Log.Stdout != "" {
+		logFile, err := openLogFile(s.conf.Log.Stdout, s.storage, nil)
+		if err != nil {
+			logMessage(LevelWarn, s.name, fmt.Sprintf("Service %v cannot open stdout log file %v: %v. defaulting to daemon log", s.name, s.conf.Log.Stdout, err))
+		} else {
+			stdout = logFile
+			logFiles = append(logFiles, logFile)
+		}
+	}
+	if s.conf.Log.Stderr != "" && s.conf.Log.Stderr == s.conf.Log.Stdout && stdout != nil {
+		// A single log file for both, so it is not rotated twice
+		stderr = stdout
+	} else if s.conf.Log.Stderr != "" {
+		logFile, err := openLogFile(s.conf.Log.Stderr, s.storage, nil)
+		if err != nil {
+			logMessage(LevelWarn, s.name, fmt.Sprintf("Service %v cannot open stderr log file %v: %v. defaulting to daemon log", s.name, s.conf.Log.Stderr, err))
+		} else {
+			stderr = logFile
+			logFiles = append(logFiles, logFile)
+		}
+	}
+
+	// The log files are closed once both streams are closed
+	var copies sync.WaitGroup
+	copies.Add(2)
+	drained = make(chan bool)
+	go func() {
+		copies.Wait()
+		for _, logFile := range logFiles {
+			logFile.Close()
+		}
+		close(drained)
+	}()
+
+	stdoutPipe, err = s.output.pipe(StreamStdout, stdout, copies.Done)
+	if err != nil {
+		copies.Done()
+		copies.Done()
+		return nil, nil, nil, err
+	}
+	stderrPipe, err = s.output.pipe(StreamStderr, stderr, copies.Done)
+	if err != nil {
+		stdoutPipe.Close()
+		copies.Done()
+		return nil, nil, nil, err
+	}
+	return stdoutPipe, stderrPipe, drained, nil
+}
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathMatcher matches the files watched for a service
+// Paths are absolute files, directories (watched recursively) or glob patterns where ** matches any number of directories
+// Ignore patterns without a slash are matched against file and directory names, the others against full paths
+type pathMatcher struct {
+	patterns []string
+	ignore   []string
+}
+
+func newPathMatcher(paths []string, ignore []string) pathMatcher {
+	matcher := pathMatcher{ignore: ignore}
+	for _, watchPath := range paths {
+		if !hasMeta(watchPath) {
+			if info, err := os.Stat(watchPath); err == nil && info.IsDir() {
+				watchPath += "/**"
+			}
+		}
+		matcher.patterns = append(matcher.patterns, watchPath)
+	}
+	return matcher
+}
+
+func (m pathMatcher) Match(name string) bool {
+	if m.Ignored(name) {
+		return false
+	}
+	for _, pattern := range m.patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m pathMatcher) Ignored(name string) bool {
+	for _, pattern := range m.ignore {
+		if strings.Contains(pattern, "/") {
+			if matchPattern(pattern, name) || matchPattern(pattern+"/**", name) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// directories lists the directories to watch to receive the events of every matching file
+func (m pathMatcher) directories() []string {
+	var directories []string
+	for _, pattern := range m.patterns {
+		root, recursive := patternRoot(pattern)
+		if !recursive {
+			directories = append(directories, root)
+			continue
+		}
+		directories = append(directories, m.walk(root)...)
+	}
+	return directories
+}
+
+// walk lists a directory and its subdirectories, except the ignored ones
+func (m pathMatcher) walk(root string) []string {
+	var directories []string
+	filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if m.Ignored(name) {
+			return filepath.SkipDir
+		}
+		directories = append(directories, name)
+		return nil
+	})
+	return directories
+}
+
+// watchesRecursively checks if new subdirectories of this directory must be watched
+func (m pathMatcher) watchesRecursively(directory string) bool {
+	if m.Ignored(directory) {
+		return false
+	}
+	for _, pattern := range m.patterns {
+		root, recursive := patternRoot(pattern)
+		if recursive && (directory == root || strings.HasPrefix(directory, root+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternRoot returns the deepest directory containing every file matching the pattern
+// and whether its subdirectories must be watched too
+func patternRoot(pattern string) (string, bool) {
+	if !hasMeta(pattern) {
+		return path.Dir(pattern), false
+	}
+
+	segments := strings.Split(pattern, "/")
+	i := 0
+	for i < len(segments) && !hasMeta(segments[i]) {
+		i++
+	}
+	root := strings.Join(segments[:i], "/")
+	if root == "" {
+		root = "/"
+	}
+	// Without ** the pattern can still match in subdirectories when a directory segment is a glob
+	return root, i < len(segments)-1 || segments[i] == "**"
+}
+
+// matchPattern matches a slash separated name against a glob pattern where ** matches zero or more directories
+func matchPattern(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if matched, err := path.Match(pattern[0], name[0]); err != nil || !matched {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
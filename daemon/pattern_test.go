@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matches bool
+	}{
+		{"/app/templates/**/*.html", "/app/templates/index.html", true},
+		{"/app/templates/**/*.html", "/app/templates/admin/index.html", true},
+		{"/app/templates/**/*.html", "/app/templates/admin/users/list.html", true},
+		{"/app/templates/**/*.html", "/app/templates/admin/style.css", false},
+		{"/app/templates/**/*.html", "/app/index.html", false},
+		{"/app/config/*.yaml", "/app/config/app.yaml", true},
+		{"/app/config/*.yaml", "/app/config/local/app.yaml", false},
+		{"/app/config/*.yaml", "/app/config/app.yml", false},
+		{"/app/src/**", "/app/src", true},
+		{"/app/src/**", "/app/src/main.go", true},
+		{"/app/src/**", "/app/src/pkg/util.go", true},
+		{"/app/src/**", "/app/srcs/main.go", false},
+		{"/app/*/main.go", "/app/cmd/main.go", true},
+		{"/app/*/main.go", "/app/cmd/server/main.go", false},
+		{"/app/main.go", "/app/main.go", true},
+		{"/app/main.go", "/app/main.go.swp", false},
+	}
+
+	for _, test := range tests {
+		if matched := matchPattern(test.pattern, test.name); matched != test.matches {
+			t.Errorf("matchPattern(%q, %q) = %v, expected %v", test.pattern, test.name, matched, test.matches)
+		}
+	}
+}
+
+func TestPathMatcherDirectory(t *testing.T) {
+	directory := t.TempDir()
+	err := os.Mkdir(path.Join(directory, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(directory, "file.txt")
+	err = os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := newPathMatcher([]string{directory, file, path.Join(directory, "missing")}, nil)
+	expected := []string{directory + "/**", file, path.Join(directory, "missing")}
+	for i, pattern := range expected {
+		if matcher.patterns[i] != pattern {
+			t.Errorf("pattern %d is %q, expected %q", i, matcher.patterns[i], pattern)
+		}
+	}
+
+	for _, name := range []string{path.Join(directory, "a.go"), path.Join(directory, "sub/deep/b.go")} {
+		if !matcher.Match(name) {
+			t.Errorf("%v is not matched in the watched directory", name)
+		}
+	}
+	if matcher.Match(path.Dir(directory) + "/other.go") {
+		t.Error("a file outside the watched directory is matched")
+	}
+}
+
+func TestPathMatcherIgnored(t *testing.T) {
+	matcher := newPathMatcher([]string{"/app/**"}, []string{"*.tmp", "node_modules", "/app/build", "/app/logs/*.log"})
+
+	tests := []struct {
+		name    string
+		ignored bool
+	}{
+		// Name only patterns match a file or directory name at any depth
+		{"/app/cache.tmp", true},
+		{"/app/src/deep/cache.tmp", true},
+		{"/app/node_modules", true},
+		{"/app/web/node_modules", true},
+		{"/app/src/tmp.go", false},
+		{"/app/node_modules_backup", false},
+		// Path patterns match full paths, and the content of matching directories
+		{"/app/build", true},
+		{"/app/build/out/main", true},
+		{"/app/src/build", false},
+		{"/app/logs/app.log", true},
+		{"/app/logs/old/app.log", false},
+		{"/app/main.go", false},
+	}
+
+	for _, test := range tests {
+		if ignored := matcher.Ignored(test.name); ignored != test.ignored {
+			t.Errorf("Ignored(%q) = %v, expected %v", test.name, ignored, test.ignored)
+		}
+		if matched := matcher.Match(test.name); matched == test.ignored {
+			t.Errorf("Match(%q) = %v, expected %v", test.name, matched, !test.ignored)
+		}
+	}
+}
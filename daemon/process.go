@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"syscall"
+	"time"
+)
+
+// Services run in their own process group, so signals reach the processes they fork too
+
+func signalGroup(pid int, signal syscall.Signal) error {
+	return syscall.Kill(-pid, signal)
+}
+
+// groupAlive checks if a process of the group still exists
+func groupAlive(pid int) bool {
+	return syscall.Kill(-pid, 0) == nil
+}
+
+// waitGroup waits for every process of the group to exit, until the deadline
+func waitGroup(pid int, deadline time.Time) bool {
+	for groupAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// aliveProcesses filters the processes that still exist
+func aliveProcesses(pids []int) []int {
+	var alive []int
+	for _, pid := range pids {
+		if syscall.Kill(pid, 0) == nil {
+			alive = append(alive, pid)
+		}
+	}
+	return alive
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package daemon
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processAttributes puts the service in its own process group
+// With killWithDaemon the kernel kills the service when the daemon dies, even on SIGKILL
+// Note that Pdeathsig is tied to the thread that started the process, not to the daemon process
+func processAttributes(killWithDaemon bool) *syscall.SysProcAttr {
+	attributes := &syscall.SysProcAttr{Setpgid: true}
+	if killWithDaemon {
+		attributes.Pdeathsig = syscall.SIGKILL
+	}
+	return attributes
+}
+
+// redirectOutput makes the standard output and error of the daemon write to the file
+func redirectOutput(file *os.File) error {
+	err := syscall.Dup3(int(file.Fd()), 1, 0)
+	if err != nil {
+		return err
+	}
+	return syscall.Dup3(int(file.Fd()), 2, 0)
+}
+
+// descendants lists the processes forked by a process, directly or not, from /proc
+func descendants(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command name can contain spaces and parentheses, the fields after it are "state ppid ..."
+		fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+
+	var result []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		result = append(result, queue[0])
+		queue = append(queue[1:], children[queue[0]]...)
+	}
+	return result
+}
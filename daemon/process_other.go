@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// processAttributes puts the service in its own process group
+// killWithDaemon needs Pdeathsig which only exists on Linux
+func processAttributes(killWithDaemon bool) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// redirectOutput makes the standard output and error of the daemon write to the file
+func redirectOutput(file *os.File) error {
+	err := syscall.Dup2(int(file.Fd()), 1)
+	if err != nil {
+		return err
+	}
+	return syscall.Dup2(int(file.Fd()), 2)
+}
+
+// descendants needs /proc, elsewhere only the process group is checked after a stop
+func descendants(pid int) []int {
+	return nil
+}
@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ProtocolVersion is the version of the control socket protocol
+// It must be incremented on every incompatible change of the requests or responses
+const ProtocolVersion = 1
+
+// Request is sent by the CLI to the daemon, one JSON document per line
+type Request struct {
+	Version int             `json:"version"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Response is sent back by the daemon for each request, one JSON document per line
+// Streaming commands send several responses, all of them but the last one have More set
+type Response struct {
+	Version int             `json:"version"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	More    bool            `json:"more,omitempty"`
+}
+
+// Commands understood by the daemon
+const (
+	CommandPing     = "ping"
+	CommandStatus   = "status"
+	CommandRestart  = "restart"
+	CommandReload   = "reload"
+	CommandHistory  = "history"
+	CommandRollback = "rollback"
+	CommandGC       = "gc"
+	// Streaming
+	CommandLogs   = "logs"
+	CommandEvents = "events"
+)
+
+type PingResult struct {
+	Pid       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type ServiceStatus struct {
+	Name      string       `json:"name"`
+	State     ServiceState `json:"state"`
+	Pid       int          `json:"pid,omitempty"`
+	Port      int          `json:"port,omitempty"`
+	StartedAt *time.Time   `json:"started_at,omitempty"`
+	Uptime    int64        `json:"uptime_seconds"`
+	Restarts  int          `json:"restarts"`
+	ExitCode  *int         `json:"exit_code"`
+	Binary    string       `json:"binary"`
+	Build     *BuildStatus `json:"build,omitempty"`
+	Health    HealthState  `json:"health,omitempty"`
+	Warning   string       `json:"warning,omitempty"`
+	// Last lines written by the service, when requested
+	Output []LogLine `json:"output,omitempty"`
+}
+
+type StatusArgs struct {
+	Lines int `json:"lines,omitempty"`
+}
+
+type BuildStatus struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	Output   string    `json:"output,omitempty"`
+}
+
+type RestartArgs struct {
+	Services []string `json:"services,omitempty"`
+	All      bool     `json:"all,omitempty"`
+}
+
+// ServiceResult reports the outcome of a command applied to a single service
+type ServiceResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReloadResult struct {
+	Added     []string        `json:"added,omitempty"`
+	Removed   []string        `json:"removed,omitempty"`
+	Restarted []string        `json:"restarted,omitempty"`
+	Unchanged []string        `json:"unchanged,omitempty"`
+	Failed    []ServiceResult `json:"failed,omitempty"`
+}
+
+type ServiceArgs struct {
+	Service string `json:"service"`
+}
+
+type HistoryResult struct {
+	Current  int             `json:"current"`
+	Versions []BinaryVersion `json:"versions"`
+}
+
+type RollbackArgs struct {
+	Service string `json:"service"`
+	// Version to run, 0 means the one before the current version
+	Version int `json:"version,omitempty"`
+}
+
+type GCResult struct {
+	Removed   []string `json:"removed,omitempty"`
+	Reclaimed int64    `json:"reclaimed"`
+}
+
+type LogsArgs struct {
+	// Every service when empty
+	Services []string `json:"services,omitempty"`
+	Follow   bool     `json:"follow,omitempty"`
+	// Number of past lines to send, 0 means all of them
+	Lines  int        `json:"lines,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+	Stderr bool       `json:"stderr,omitempty"`
+}
+
+type EventsArgs struct {
+	// Every service when empty
+	Services []string `json:"services,omitempty"`
+	// Every type of lifecycle event when empty
+	Types []string `json:"types,omitempty"`
+}
+
+// LogLine is a line written by a service
+type LogLine struct {
+	Service string    `json:"service"`
+	Stream  string    `json:"stream"`
+	Time    time.Time `json:"time"`
+	Line    string    `json:"line"`
+}
@@ -0,0 +1,220 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arnopensource/devo/config"
+)
+
+// Interval between two connection attempts to a service that is restarting
+const proxyRetryInterval = 100 * time.Millisecond
+
+// Number of error lines shown when a service cannot answer
+const proxyErrorLines = 20
+
+type proxyServiceKey struct{}
+
+// proxyRouter is a reverse proxy inside the daemon, routing the requests to the services by their host
+// It replaces Caddy when [proxy] listen is set
+type proxyRouter struct {
+	lookup  func(name string) (*Service, error)
+	dialer  net.Dialer
+	handler *httputil.ReverseProxy
+
+	mutex sync.Mutex
+	hold  time.Duration
+	// Host to service, and service to port
+	hosts map[string]string
+	ports map[string]int
+}
+
+func newProxyRouter(conf config.Proxy, lookup func(name string) (*Service, error)) *proxyRouter {
+	p := &proxyRouter{
+		lookup: lookup,
+		dialer: net.Dialer{Timeout: 5 * time.Second},
+		hold:   time.Duration(conf.Hold) * time.Second,
+		hosts:  make(map[string]string),
+		ports:  make(map[string]int),
+	}
+	p.handler = &httputil.ReverseProxy{
+		Director: func(request *http.Request) {
+			// The address is chosen when dialing, the port of the service may change until then
+			request.URL.Scheme = "http"
+			request.URL.Host = "localhost"
+		},
+		// Services are restarted often, connections are not reused so none points to a stopped process
+		Transport:    &http.Transport{DialContext: p.dial, DisableKeepAlives: true},
+		ErrorHandler: p.serviceError,
+	}
+	return p
+}
+
+// serve listens for requests until the returned server is closed
+func (p *proxyRouter) serve(listen string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %s", listen, err)
+	}
+
+	server := &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logMessage(LevelError, "", fmt.Sprint("Error serving proxy: ", err))
+		}
+	}()
+	return server, nil
+}
+
+func (p *proxyRouter) setHold(hold int) {
+	p.mutex.Lock()
+	p.hold = time.Duration(hold) * time.Second
+	p.mutex.Unlock()
+}
+
+func (p *proxyRouter) SetRoute(service string, host string, port int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.removeHosts(service)
+	p.hosts[strings.ToLower(host)] = service
+	p.ports[service] = port
+	return nil
+}
+
+func (p *proxyRouter) RemoveRoute(service string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.removeHosts(service)
+	delete(p.ports, service)
+	return nil
+}
+
+// removeHosts forgets the hosts of the service, the caller must hold p.mutex
+func (p *proxyRouter) removeHosts(service string) {
+	for host, name := range p.hosts {
+		if name == service {
+			delete(p.hosts, host)
+		}
+	}
+}
+
+func (p *proxyRouter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	host, port := strings.ToLower(request.Host), ""
+	if hostname, hostPort, err := net.SplitHostPort(host); err == nil {
+		host, port = hostname, ":"+hostPort
+	}
+
+	p.mutex.Lock()
+	service, ok := p.hosts[host]
+	hosts := make([]string, 0, len(p.hosts))
+	for known := range p.hosts {
+		hosts = append(hosts, known)
+	}
+	p.mutex.Unlock()
+
+	if !ok {
+		sort.Strings(hosts)
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.WriteHeader(http.StatusNotFound)
+		unknownHostPage.Execute(writer, map[string]interface{}{"Host": host, "Port": port, "Hosts": hosts})
+		return
+	}
+
+	request = request.WithContext(context.WithValue(request.Context(), proxyServiceKey{}, service))
+	p.handler.ServeHTTP(writer, request)
+}
+
+// dial connects to the current port of the service, and waits for it while it is restarting
+func (p *proxyRouter) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	service, _ := ctx.Value(proxyServiceKey{}).(string)
+
+	p.mutex.Lock()
+	deadline := time.Now().Add(p.hold)
+	p.mutex.Unlock()
+
+	for {
+		p.mutex.Lock()
+		port, ok := p.ports[service]
+		p.mutex.Unlock()
+		if !ok {
+			return nil, errors.New("service is not routed anymore")
+		}
+
+		conn, err := p.dialer.DialContext(ctx, network, fmt.Sprintf("localhost:%d", port))
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(proxyRetryInterval):
+		}
+	}
+}
+
+// serviceError answers with the state and the last errors of a service that could not answer
+func (p *proxyRouter) serviceError(writer http.ResponseWriter, request *http.Request, err error) {
+	name, _ := request.Context().Value(proxyServiceKey{}).(string)
+	data := map[string]interface{}{"Service": name, "Error": err.Error()}
+
+	if service, lookupErr := p.lookup(name); lookupErr == nil {
+		status := service.Status()
+		data["State"] = status.State
+		if status.State != StateRunning {
+			data["ExitCode"] = status.ExitCode
+		}
+		var lines []string
+		for _, line := range service.output.recent(0) {
+			if line.Stream == StreamStderr {
+				lines = append(lines, line.Line)
+			}
+		}
+		if len(lines) > proxyErrorLines {
+			lines = lines[len(lines)-proxyErrorLines:]
+		}
+		data["Lines"] = lines
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusBadGateway)
+	serviceErrorPage.Execute(writer, data)
+}
+
+var serviceErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Service}} is not answering</title></head>
+<body style="font-family: sans-serif; margin: 2em">
+<h1>{{.Service}} is not answering</h1>
+<p>{{if .State}}The service is {{.State}}{{if .ExitCode}}, it exited with code {{.ExitCode}}{{end}}. {{end}}{{.Error}}</p>
+{{if .Lines}}<h2>Last errors</h2>
+<pre style="background: #f4f4f4; padding: 1em; overflow: auto">{{range .Lines}}{{.}}
+{{end}}</pre>{{end}}
+<p><small>devo</small></p>
+</body>
+</html>
+`))
+
+var unknownHostPage = template.Must(template.New("unknown").Parse(`<!DOCTYPE html>
+<html>
+<head><title>No service for {{.Host}}</title></head>
+<body style="font-family: sans-serif; margin: 2em">
+<h1>No service for {{.Host}}</h1>
+{{if .Hosts}}<p>Running services:</p>
+<ul>{{range .Hosts}}<li><a href="http://{{.}}{{$.Port}}/">{{.}}</a></li>{{end}}</ul>{{else}}<p>No service is running.</p>{{end}}
+<p><small>devo</small></p>
+</body>
+</html>
+`))
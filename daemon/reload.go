@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/arnopensource/devo/config"
+)
+
+// reload parses the configuration file again and applies the differences to the running services
+// Services that are not affected by the new configuration keep running untouched
+func (r *runner) reload() (ReloadResult, error) {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	var result ReloadResult
+	r.mutex.Lock()
+	stopped := r.stopped
+	r.mutex.Unlock()
+	if stopped {
+		return result, errors.New("the daemon is stopping")
+	}
+
+	newConfig, err := config.Parse(r.configFileName)
+	if err != nil {
+		return result, err
+	}
+
+	r.mutex.Lock()
+	oldConfig := r.config
+	services := r.servicesSnapshot()
+	r.mutex.Unlock()
+
+	if newConfig.Storage.PidFile != oldConfig.Storage.PidFile || newConfig.Storage.SockFile != oldConfig.Storage.SockFile ||
+		newConfig.Storage.Log != oldConfig.Storage.Log || newConfig.Metrics.Listen != oldConfig.Metrics.Listen ||
+		newConfig.Proxy.Listen != oldConfig.Proxy.Listen {
+		logMessage(LevelWarn, "", "Warning : pid_file, sock_file, log, metrics and proxy listen changes are only applied when the daemon restarts")
+	}
+	setLogFormat(newConfig.LogFormat)
+	if r.daemonLog != nil {
+		r.daemonLog.setRotation(newConfig.Storage)
+	}
+	// kill_delay is copied to the services using it, so they see it changed
+	globalChanged := newConfig.Storage.Binaries != oldConfig.Storage.Binaries ||
+		newConfig.Storage.History != oldConfig.Storage.History ||
+		newConfig.Storage.LogMaxSize != oldConfig.Storage.LogMaxSize ||
+		newConfig.Storage.LogKeep != oldConfig.Storage.LogKeep ||
+		newConfig.Storage.LogCompress != oldConfig.Storage.LogCompress
+	if r.proxy != nil {
+		r.proxy.setHold(newConfig.Proxy.Hold)
+	} else if !reflect.DeepEqual(newConfig.Caddy, oldConfig.Caddy) {
+		globalChanged = true
+		r.router = newCaddyRouter(newConfig.Caddy)
+	}
+
+	oldServices := make(map[string]config.Service, len(oldConfig.Services))
+	for _, service := range oldConfig.Services {
+		oldServices[service.Name] = service
+	}
+	newServices := make(map[string]config.Service, len(newConfig.Services))
+	for _, service := range newConfig.Services {
+		newServices[service.Name] = service
+	}
+
+	// Removed services are stopped first, in reverse order, to free their resources
+	oldOrder := oldConfig.StartOrder()
+	for i := len(oldOrder) - 1; i >= 0; i-- {
+		name := oldOrder[i]
+		if _, ok := newServices[name]; ok {
+			continue
+		}
+
+		logEvent(Event{Type: EventServiceRemoved, Service: name, Message: fmt.Sprintf("Removing service %v (configuration reloaded)", name)})
+		services[name].cancelRestart(false)
+		if services[name].IsRunning() {
+			err = services[name].Stop()
+			if err != nil {
+				result.Failed = append(result.Failed, ServiceResult{Name: name, Error: err.Error()})
+			}
+		} else {
+			services[name].release()
+		}
+		delete(services, name)
+		result.Removed = append(result.Removed, name)
+	}
+
+	newOrder := make([]string, 0, len(newConfig.Services))
+	for _, serviceConf := range newConfig.Services {
+		newOrder = append(newOrder, serviceConf.Name)
+	}
+
+	// Services depending on a restarted service are restarted after it, by the loop rather than by notifyRestarted,
+	// which follows the previous configuration until the reload is done
+	dependencyRestarted := make(map[string]string)
+	for _, name := range newConfig.StartOrder() {
+		serviceConf := newServices[name]
+		oldServiceConf, exists := oldServices[name]
+		unchanged := exists && !globalChanged && reflect.DeepEqual(oldServiceConf, serviceConf)
+		if unchanged && dependencyRestarted[name] == "" {
+			result.Unchanged = append(result.Unchanged, name)
+			continue
+		}
+
+		waitDependencies(services, serviceConf)
+		switch {
+		case !exists:
+			logEvent(Event{Type: EventServiceAdded, Service: name, Message: fmt.Sprintf("Adding service %v (configuration reloaded)", name)})
+			services[name] = r.newService(newConfig, serviceConf)
+			err = services[name].Start()
+			result.Added = append(result.Added, name)
+		case unchanged:
+			dependency := dependencyRestarted[name]
+			logRestart(name, ReasonDependency, fmt.Sprintf("Restarting service %v (dependency %v restarted)", name, dependency))
+			err = services[name].restartAlone()
+			result.Restarted = append(result.Restarted, name)
+		default:
+			logRestart(name, ReasonConfigChanged, fmt.Sprintf("Restarting service %v (configuration changed)", name))
+			err = services[name].Reconfigure(newConfig.Storage, serviceConf, r.router)
+			result.Restarted = append(result.Restarted, name)
+		}
+		if exists {
+			for _, dependent := range newConfig.Dependents(name) {
+				if dependencyRestarted[dependent] == "" {
+					dependencyRestarted[dependent] = name
+				}
+			}
+		}
+
+		if err != nil {
+			result.Failed = append(result.Failed, ServiceResult{Name: name, Error: err.Error()})
+		}
+	}
+
+	for _, service := range services {
+		service.output.resize(newConfig.Storage.OutputLines)
+	}
+
+	r.mutex.Lock()
+	r.config = newConfig
+	r.services = services
+	r.servicesOrder = newOrder
+	r.updateWatches()
+	r.mutex.Unlock()
+
+	r.requestGarbageCollection()
+
+	logEvent(Event{Type: EventConfigReloaded, Message: fmt.Sprintf("Configuration reloaded: %d added, %d removed, %d restarted, %d unchanged",
+		len(result.Added), len(result.Removed), len(result.Restarted), len(result.Unchanged))})
+	return result, nil
+}
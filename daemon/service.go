@@ -1,14 +1,17 @@
 package daemon
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -16,150 +19,770 @@ import (
 	"github.com/arnopensource/devo/config"
 )
 
+type ServiceState string
+
+const (
+	StateRunning ServiceState = "running"
+	StateStopped ServiceState = "stopped"
+	StateCrashed ServiceState = "crashed"
+	// StateCrashLoop means the service exited too many times in a row and will not be restarted automatically
+	StateCrashLoop ServiceState = "crash_loop"
+)
+
 type Service struct {
-	// Conf
-	binaryStorageFolder string
-	killDelay           int
-	conf                config.Service
+	// Never changes, read without lock
+	name string
+	// Conf, written with both s.mutex and stateMutex held, see currentConf
+	storage config.Storage
+	conf    config.Service
+	router  Router
+
+	// Hooks
+	binaryCopied func()
+	restarted    func()
 
 	// State
+	output        *serviceOutput
+	mutex         sync.Mutex
+	buildMutex    sync.Mutex
 	command       *exec.Cmd
+	exitedChannel chan bool
 	binaryName    string
 	isRunningFlag int32
-	logFiles      struct {
-		stdout *os.File
-		stderr *os.File
-	}
+	// Sockets passed to the service, see handoff
+	listeners       []*os.File
+	listenAddresses []string
+
+	// Status, read concurrently by the control socket
+	stateMutex    sync.Mutex
+	state         ServiceState
+	pid           int
+	startedAt     time.Time
+	port          int
+	restarts      int
+	exitCode      *int
+	stopRequested bool
+	retries       []time.Time
+	restartTimer  *time.Timer
+	history       *binaryHistory
+	version       int
+	lastBuild     *BuildStatus
+	health        HealthState
+	warning       string
 }
 
-func NewService(binaryStorageFolder string, killDelay int, conf config.Service) *Service {
+func NewService(storage config.Storage, conf config.Service, router Router) *Service {
 	service := &Service{
-		binaryStorageFolder: binaryStorageFolder,
-		killDelay:           killDelay,
-		conf:                conf,
+		name:    conf.Name,
+		storage: storage,
+		conf:    conf,
+		router:  router,
+		state:   StateStopped,
+		output:  newServiceOutput(conf.Name, storage.OutputLines),
 	}
 	service.setRunning(false)
+	service.loadHistory()
 	return service
 }
 
-func (s *Service) Start() {
+func (s *Service) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.start()
+}
+
+func (s *Service) start() error {
 	if s.IsRunning() {
-		log.Printf("Service %v is already running, double run not supported yet\n", s.conf.Name)
-		return
+		logMessage(LevelWarn, s.name, fmt.Sprintf("Service %v is already running", s.name))
+		return fmt.Errorf("service %v is already running", s.name)
 	}
 
-	log.Printf("Starting service %v\n", s.conf.Name)
+	logEvent(Event{Type: EventStarting, Service: s.name, Message: fmt.Sprintf("Starting service %v", s.name)})
 
 	err := s.copyBinary()
 	if err != nil {
-		log.Printf("Cannot start service %v: %v\n", s.conf.Name, err)
-		return
+		s.startFailed(err)
+		return err
 	}
 
-	binary := path.Clean(s.binaryStorageFolder + "/" + s.binaryName)
-	if s.conf.Command != "" {
-		command := strings.Split(strings.ReplaceAll(s.conf.Command, "{binary}", binary), " ")
-		name := command[0]
-		args := command[1:]
-		s.command = exec.Command(name, args...)
-	} else {
-		s.command = exec.Command(binary)
+	return s.launch()
+}
+
+// process is a run of the service binary
+// A handoff runs the next process alongside the current one until it is ready
+type process struct {
+	command *exec.Cmd
+	// Configuration of the run, the port may be the swap port
+	conf       config.Service
+	startedAt  time.Time
+	replacer   *strings.Replacer
+	drained    chan bool
+	healthStop chan bool
+	// Readiness of a process on shared sockets, nil otherwise
+	notify *notifySocket
+	// Closed once the process exited
+	exited chan bool
+	// Set once the process exited, guarded by stateMutex
+	ended bool
+}
+
+// launch runs the current copy of the binary
+func (s *Service) launch() error {
+	p, err := s.spawn(s.conf.Port)
+	if err != nil {
+		s.startFailed(err)
+		return err
+	}
+	s.adopt(p)
+	go s.wait(p)
+	return nil
+}
+
+// spawn starts a process of the current copy of the binary on the port, without making it the current process of the service
+func (s *Service) spawn(port int) (*process, error) {
+	var err error
+
+	conf := s.conf
+	if conf.Health.Port == conf.Port {
+		conf.Health.Port = port
 	}
-	s.command.Dir = s.conf.Dir
+	conf.Port = port
+
+	binary := path.Clean(s.storage.Binaries + "/" + s.binaryName)
+	replacer := placeholders(conf, binary)
+	args := []string{binary}
+	if conf.Command != "" || len(conf.Args) > 0 {
+		args, err = commandArgs(conf.Command, conf.Args, conf.Env, replacer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command: %s", err)
+		}
+	}
+	command := exec.Command(args[0], args[1:]...)
+	command.Dir = s.conf.Dir
+	command.SysProcAttr = processAttributes(s.conf.KillWithDaemon)
 
 	env := make([]string, 0, len(s.conf.Env))
 	for key, value := range s.conf.Env {
 		env = append(env, fmt.Sprintf("%v=%v", key, value))
 	}
-	s.command.Env = append(os.Environ(), env...)
+	command.Env = append(os.Environ(), env...)
 
-	//Stdout
-	if s.conf.Log.Stdout != "" {
-		filename := config.UseDateInFilename(s.conf.Log.Stdout)
-		s.logFiles.stdout, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	err = s.openListeners()
+	if err != nil {
+		return nil, err
+	}
+	var notify *notifySocket
+	if len(s.listeners) > 0 {
+		notify, err = openNotifySocket(path.Dir(s.storage.SockFile))
 		if err != nil {
-			log.Printf("Service %v cannot open stdout log file %v: %v. defaulting to daemon log\n", s.conf.Name, filename, err)
-			s.command.Stdout = os.Stdout
-		} else {
-			s.command.Stdout = s.logFiles.stdout
+			return nil, err
+		}
+		command, err = s.passListeners(command, args, notify)
+		if err != nil {
+			notify.Close()
+			return nil, err
 		}
-	} else {
-		s.command.Stdout = os.Stdout
 	}
 
-	//Stderr
-	if s.conf.Log.Stderr != "" {
-		filename := config.UseDateInFilename(s.conf.Log.Stderr)
-		s.logFiles.stderr, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			log.Printf("Service %v cannot open stderr log file %v: %v. defaulting to daemon log\n", s.conf.Name, filename, err)
-			s.command.Stderr = os.Stderr
-		} else {
-			s.command.Stderr = s.logFiles.stderr
+	// Outputs, written by the service into pipes read by the daemon
+	stdout, stderr, drained, err := s.openOutputs()
+	if err != nil {
+		if notify != nil {
+			notify.Close()
 		}
-	} else {
-		s.command.Stderr = os.Stderr
+		return nil, err
+	}
+	command.Stdout = stdout
+	command.Stderr = stderr
+
+	err = command.Start()
+	// The service has its own copy of the pipes now
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		if notify != nil {
+			notify.Close()
+		}
+		return nil, err
 	}
 
+	logEvent(Event{Type: EventStarted, Service: s.name, Pid: command.Process.Pid, Binary: s.binaryName,
+		Message: fmt.Sprintf("Service %v started with pid %v", s.name, command.Process.Pid)})
+
+	return &process{
+		command:    command,
+		conf:       conf,
+		startedAt:  time.Now(),
+		replacer:   replacer,
+		drained:    drained,
+		healthStop: make(chan bool),
+		notify:     notify,
+		exited:     make(chan bool),
+	}, nil
+}
+
+// adopt makes the process the current process of the service, it returns false if the process already exited
+func (s *Service) adopt(p *process) bool {
+	s.stateMutex.Lock()
+	if p.ended {
+		s.stateMutex.Unlock()
+		return false
+	}
+	s.state = StateRunning
+	s.pid = p.command.Process.Pid
+	s.startedAt = p.startedAt
+	s.port = p.conf.Port
+	s.stopRequested = false
 	s.setRunning(true)
-	go func() {
-		defer s.setRunning(false)
-		err = s.command.Run()
+	s.stateMutex.Unlock()
+
+	s.command = p.command
+	s.exitedChannel = p.exited
+
+	if s.conf.Health.Type != "" {
+		go s.checkHealth(p.conf, p.replacer, p.command, p.healthStop)
+	}
+	s.setRoute()
+	return true
+}
+
+// wait waits for the process to exit, and restarts the service if the current process exits unexpectedly
+func (s *Service) wait(p *process) {
+	err := p.command.Wait()
+	close(p.healthStop)
+	if p.notify != nil {
+		p.notify.Close()
+	}
+
+	exitCode := p.command.ProcessState.ExitCode()
+	unexpected := s.exited(p, exitCode)
+
+	event := Event{Type: EventExited, Service: s.name, Pid: p.command.Process.Pid, ExitCode: &exitCode}
+	if unexpected && exitCode != 0 {
+		event.Level = LevelError
+	}
+	if _, errorIsExitError := err.(*exec.ExitError); err != nil && !errorIsExitError {
+		event.Level = LevelError
+		event.Message = fmt.Sprint("Error running service: ", err)
+	} else {
+		event.Message = fmt.Sprintf("Service %v exited with exit code %v", s.name, exitCode)
+	}
+	logEvent(event)
+
+	close(p.exited)
+	if unexpected && exitCode != 0 {
+		s.reportCrash(p.startedAt, p.drained)
+	}
+	if unexpected {
+		s.scheduleRestart(exitCode)
+	}
+}
+
+// startFailed records a service that could not start
+func (s *Service) startFailed(err error) {
+	logEvent(Event{Type: EventStartFailed, Level: LevelError, Service: s.name, Reason: err.Error(),
+		Message: fmt.Sprintf("Cannot start service %v: %v", s.name, err)})
+	s.stateMutex.Lock()
+	s.state = StateCrashed
+	s.stateMutex.Unlock()
+}
+
+// exited records the end of the process, a process is considered crashed if it exits with an error without being asked to
+// It returns true if the current process was not asked to stop, a process replaced by a handoff only ends
+func (s *Service) exited(p *process, exitCode int) bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	p.ended = true
+	if s.pid != p.command.Process.Pid {
+		return false
+	}
+	s.setRunning(false)
+	s.exitCode = &exitCode
+	s.pid = 0
+	s.health = ""
+	if exitCode != 0 && !s.stopRequested {
+		s.state = StateCrashed
+	} else {
+		s.state = StateStopped
+	}
+	return !s.stopRequested
+}
 
-		if _, errorIsExitError := err.(*exec.ExitError); err != nil && !errorIsExitError {
-			log.Println("Error running service:", err)
-			return
+// scheduleRestart restarts the service after an unexpected exit if its restart policy allows it
+// The delay doubles with each restart in the retry window, and the service is left in crash loop after max_retries
+func (s *Service) scheduleRestart(exitCode int) {
+	policy := s.currentConf().Restart
+	if exitCode != 0 && !policy.OnError || exitCode == 0 && !policy.OnExit {
+		return
+	}
+
+	// The event is logged once unlocked, observers must not run under stateMutex
+	event := s.planRestart(exitCode)
+	logEvent(event)
+}
+
+// planRestart records the restart and schedules it, or leaves the service in crash loop
+func (s *Service) planRestart(exitCode int) Event {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	policy := s.conf.Restart
+
+	now := time.Now()
+	window := time.Duration(policy.RetryWindow) * time.Second
+	retries := s.retries[:0]
+	for _, retry := range s.retries {
+		if now.Sub(retry) < window {
+			retries = append(retries, retry)
 		}
+	}
+	s.retries = retries
 
-		log.Printf("Service %v exited with exit code %v\n", s.conf.Name, s.command.ProcessState.ExitCode())
-	}()
+	if len(s.retries) >= policy.MaxRetries {
+		s.state = StateCrashLoop
+		return Event{Type: EventCrashLoop, Level: LevelError, Service: s.name, ExitCode: &exitCode,
+			Message: fmt.Sprintf("Service %v exited %d times in %v, not restarting it anymore (crash loop)", s.name, len(s.retries)+1, window)}
+	}
+
+	delay := time.Duration(policy.Delay) * time.Second
+	maxDelay := time.Duration(policy.MaxDelay) * time.Second
+	for i := 0; i < len(s.retries) && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	s.retries = append(s.retries, now)
+
+	s.restartTimer = time.AfterFunc(delay, func() {
+		if s.autoRestart() {
+			s.notifyRestarted()
+		}
+	})
+	return Event{Type: EventRestartScheduled, Service: s.name, ExitCode: &exitCode, Reason: restartReason(exitCode),
+		Message: fmt.Sprintf("Restarting service %v in %v (exited with code %v)", s.name, delay, exitCode)}
+}
+
+// autoRestart runs the service again after an unexpected exit and returns true if it started
+func (s *Service) autoRestart() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stateMutex.Lock()
+	cancelled := s.restartTimer == nil
+	s.restartTimer = nil
+	if !cancelled {
+		s.restarts++
+	}
+	s.stateMutex.Unlock()
+
+	if cancelled || s.IsRunning() {
+		return false
+	}
+
+	// Keep the binary the service was running, it may have been rolled back
+	err := s.restartProcess(true)
+	if err != nil {
+		s.scheduleRestart(-1)
+	} else {
+		s.logRestarted()
+	}
+	return err == nil
+}
+
+// cancelRestart cancels a pending automatic restart, and forgets previous ones if reset is true
+func (s *Service) cancelRestart(reset bool) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	if s.restartTimer != nil {
+		s.restartTimer.Stop()
+		s.restartTimer = nil
+	}
+	if reset {
+		s.retries = nil
+	}
+}
+
+func (s *Service) Stop() error {
+	s.cancelRestart(false)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.stop()
+	s.removeRoute()
+	s.closeListeners()
+	return err
 }
 
-func (s *Service) Stop() {
+// release frees the route and the sockets of a service that is not running
+func (s *Service) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.removeRoute()
+	s.closeListeners()
+}
+
+func (s *Service) stop() error {
 	if !s.IsRunning() {
-		log.Printf("Service %v is not running\n", s.conf.Name)
-		return
+		logMessage(LevelWarn, s.name, fmt.Sprintf("Service %v is not running", s.name))
+		return fmt.Errorf("service %v is not running", s.name)
 	}
 
-	log.Printf("Stopping service %v\n", s.conf.Name)
+	logEvent(Event{Type: EventStopping, Service: s.name, Pid: s.command.Process.Pid, Message: fmt.Sprintf("Stopping service %v", s.name)})
 
-	err := s.command.Process.Signal(syscall.SIGTERM)
+	s.stateMutex.Lock()
+	s.stopRequested = true
+	s.stateMutex.Unlock()
+
+	return s.terminate(s.command.Process.Pid, s.exitedChannel)
+}
+
+// terminate stops a process of the service and the processes it forked, killing them after kill_delay
+func (s *Service) terminate(pid int, processExited chan bool) error {
+	children := descendants(pid)
+	signal, _ := config.Signal(s.conf.StopSignal)
+	err := signalGroup(pid, signal)
 	if err != nil {
-		log.Printf("Error stopping service %v: %v\n", s.conf.Name, err)
-		return
+		logMessage(LevelError, s.name, fmt.Sprintf("Error stopping service %v: %v", s.name, err))
+		return err
 	}
 
-	// Wait for the process to exit for 3 seconds
-	for i := 0; i < 30; i++ {
-		if !s.IsRunning() {
-			break
+	// The forked processes get the same delay as the service itself
+	deadline := time.Now().Add(time.Duration(s.conf.KillDelay) * time.Second)
+	exited := false
+	select {
+	case <-processExited:
+		exited = waitGroup(pid, deadline)
+	case <-time.After(time.Until(deadline)):
+	}
+
+	if !exited {
+		logEvent(Event{Type: EventKilled, Level: LevelWarn, Service: s.name, Pid: pid,
+			Message: fmt.Sprintf("Service %v did not stop after %v seconds, sending SIGKILL", s.name, s.conf.KillDelay)})
+		err = signalGroup(pid, syscall.SIGKILL)
+		if err != nil && err != syscall.ESRCH {
+			logMessage(LevelError, s.name, fmt.Sprintf("Error killing service %v: %v", s.name, err))
+			return err
 		}
-		time.Sleep(time.Millisecond * 100)
+		<-processExited
+		waitGroup(pid, time.Now().Add(time.Second))
+	}
+
+	// Forked processes may have left the process group
+	// The warning is kept until the next stop, the survivors are still running after a restart
+	survivors := aliveProcesses(children)
+	warning := ""
+	if len(survivors) > 0 {
+		warning = fmt.Sprintf("processes survived the stop: %v", survivors)
+	} else if groupAlive(pid) {
+		warning = fmt.Sprintf("processes of group %v survived the stop", pid)
 	}
+	if warning != "" {
+		logEvent(Event{Type: EventSurvivors, Level: LevelWarn, Service: s.name, Pid: pid,
+			Message: fmt.Sprintf("Warning : service %v %v", s.name, warning)})
+	}
+	s.stateMutex.Lock()
+	s.warning = warning
+	s.stateMutex.Unlock()
+
+	return nil
+}
+
+// Restart restarts the service, then the services depending on it
+func (s *Service) Restart() error {
+	err := s.restartAlone()
+	if err == nil {
+		s.notifyRestarted()
+	}
+	return err
+}
+
+// restartAlone restarts the service without touching the services depending on it
+func (s *Service) restartAlone() error {
+	s.cancelRestart(true)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stateMutex.Lock()
+	s.restarts++
+	s.stateMutex.Unlock()
+
+	err := s.restartProcess(false)
+	if err == nil {
+		s.logRestarted()
+	}
+	return err
+}
+
+// restartProcess replaces the process of the service, through a handoff when the service has one, or starts it if it is not running
+// keepBinary runs the current copy of the binary again, which may have been rolled back, instead of copying the binary
+// The caller must hold s.mutex
+func (s *Service) restartProcess(keepBinary bool) error {
+	keepBinary = keepBinary && s.hasBinary()
+	if s.IsRunning() && s.handsOff() {
+		return s.handoff(keepBinary)
+	}
+
+	if s.IsRunning() {
+		err := s.stop()
+		if err != nil {
+			return err
+		}
+	}
+	if !keepBinary {
+		return s.start()
+	}
+	logEvent(Event{Type: EventStarting, Service: s.name, Message: fmt.Sprintf("Starting service %v", s.name)})
+	return s.launch()
+}
+
+// hasBinary reports whether the current copy of the binary can run again
+// The caller must hold s.mutex
+func (s *Service) hasBinary() bool {
+	if s.binaryName == "" {
+		return false
+	}
+	_, err := os.Stat(path.Clean(s.storage.Binaries + "/" + s.binaryName))
+	return err == nil
+}
+
+func (s *Service) logRestarted() {
+	pid := s.Status().Pid
+	logEvent(Event{Type: EventRestarted, Service: s.name, Pid: pid, Binary: s.binaryName,
+		Message: fmt.Sprintf("Service %v restarted with pid %v", s.name, pid)})
+}
+
+func (s *Service) Status() ServiceStatus {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	status := ServiceStatus{
+		Name:     s.name,
+		State:    s.state,
+		Restarts: s.restarts,
+		ExitCode: s.exitCode,
+		Binary:   s.binaryName,
+		Build:    s.lastBuild,
+		Health:   s.health,
+		Warning:  s.warning,
+	}
+	if s.state == StateRunning {
+		startedAt := s.startedAt
+		status.Pid = s.pid
+		status.Port = s.port
+		status.StartedAt = &startedAt
+		status.Uptime = int64(time.Since(startedAt).Seconds())
+	}
+	return status
+}
+
+// Reconfigure replaces the configuration of the service and restarts it with the new one
+func (s *Service) Reconfigure(storage config.Storage, conf config.Service, router Router) error {
+	s.cancelRestart(true)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	if s.IsRunning() {
-		log.Printf("Service %v did not stop, sending SIGKILL\n", s.conf.Name)
-		err = s.command.Process.Signal(syscall.SIGKILL)
+		err := s.stop()
 		if err != nil {
-			log.Printf("Error killing service %v: %v\n", s.conf.Name, err)
-			return
+			return err
 		}
 	}
 
-	// Close log files
-	if s.logFiles.stdout != nil {
-		s.logFiles.stdout.Close()
+	s.stateMutex.Lock()
+	s.restarts++
+	s.stateMutex.Unlock()
+
+	if s.conf.Caddy.Enable && (!conf.Caddy.Enable || router != s.router) {
+		s.removeRoute()
 	}
-	if s.logFiles.stderr != nil {
-		s.logFiles.stderr.Close()
+
+	binariesMoved := storage.Binaries != s.storage.Binaries
+	s.stateMutex.Lock()
+	s.storage = storage
+	s.conf = conf
+	s.router = router
+	s.stateMutex.Unlock()
+	if binariesMoved {
+		s.loadHistory()
+	}
+	err := s.start()
+	if err == nil {
+		s.logRestarted()
 	}
+	return err
 }
 
-func (s *Service) Restart() {
+// Rollback restarts the service on a binary from its history, the one before the current binary if version is 0
+func (s *Service) Rollback(version int) (BinaryVersion, error) {
+	binary, err := s.rollback(version)
+	if err == nil {
+		s.notifyRestarted()
+	}
+	return binary, err
+}
+
+func (s *Service) rollback(version int) (BinaryVersion, error) {
+	s.cancelRestart(true)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var binary BinaryVersion
+	var ok bool
+	s.stateMutex.Lock()
+	if version == 0 {
+		binary, ok = s.history.previous(s.version)
+	} else {
+		binary, ok = s.history.get(version)
+	}
+	s.stateMutex.Unlock()
+
+	if !ok && version == 0 {
+		return binary, errors.New("no previous version in history")
+	} else if !ok {
+		return binary, fmt.Errorf("version %d is not in history", version)
+	}
+	if _, err := os.Stat(path.Clean(s.storage.Binaries + "/" + binary.File)); err != nil {
+		return binary, fmt.Errorf("binary of version %d is missing: %s", binary.Version, err)
+	}
+
 	if s.IsRunning() {
-		s.Stop()
+		err := s.stop()
+		if err != nil {
+			return binary, err
+		}
+	}
+
+	logEvent(Event{Type: EventRollback, Service: s.name, Binary: binary.File,
+		Message: fmt.Sprintf("Rolling back service %v to version %v", s.name, binary.Version)})
+	s.stateMutex.Lock()
+	s.binaryName = binary.File
+	s.version = binary.Version
+	s.restarts++
+	s.stateMutex.Unlock()
+
+	return binary, s.launch()
+}
+
+func (s *Service) History() HistoryResult {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	return HistoryResult{
+		Current:  s.version,
+		Versions: append([]BinaryVersion(nil), s.history.Versions...),
+	}
+}
+
+// binaries returns the binary currently used and the history of the service
+func (s *Service) binaries() (string, []BinaryVersion) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	return s.binaryName, append([]BinaryVersion(nil), s.history.Versions...)
+}
+
+// forget removes a binary from the history, unless it is the one currently used
+func (s *Service) forget(file string) bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	if file == s.binaryName {
+		return false
 	}
-	s.Start()
+
+	versions := s.history.Versions[:0]
+	for _, binary := range s.history.Versions {
+		if binary.File != file {
+			versions = append(versions, binary)
+		}
+	}
+	s.history.Versions = versions
+
+	err := s.history.save()
+	if err != nil {
+		logMessage(LevelError, s.name, fmt.Sprintf("Cannot save binary history of service %v: %v", s.name, err))
+	}
+	return true
+}
+
+func (s *Service) loadHistory() {
+	history, err := loadHistory(s.storage.Binaries, s.name)
+	if err != nil {
+		logMessage(LevelWarn, s.name, fmt.Sprintf("Service %v binary history is lost: %v", s.name, err))
+	}
+
+	s.stateMutex.Lock()
+	s.history = history
+	s.stateMutex.Unlock()
+}
+
+// setRoute exposes the service through the router if it is enabled
+func (s *Service) setRoute() {
+	if s.router == nil || !s.conf.Caddy.Enable {
+		return
+	}
+	s.stateMutex.Lock()
+	port := s.port
+	s.stateMutex.Unlock()
+	err := s.router.SetRoute(s.name, s.conf.Caddy.Host, port)
+	if err != nil {
+		logMessage(LevelError, s.name, fmt.Sprintf("Cannot route %v to service %v: %v", s.conf.Caddy.Host, s.name, err))
+	}
+}
+
+func (s *Service) removeRoute() {
+	if s.router == nil || !s.conf.Caddy.Enable {
+		return
+	}
+	err := s.router.RemoveRoute(s.name)
+	if err != nil {
+		logMessage(LevelError, s.name, fmt.Sprintf("Cannot remove route of service %v: %v", s.name, err))
+	}
+}
+
+func (s *Service) notifyRestarted() {
+	if s.restarted != nil {
+		s.restarted()
+	}
+}
+
+// Ready reports whether the services depending on this one can start
+// A service with a health check is ready once it is healthy
+func (s *Service) Ready() bool {
+	if s.currentConf().Health.Type != "" {
+		return s.IsRunning() && s.Health() == HealthHealthy
+	}
+	return s.IsRunning()
+}
+
+// WaitReady waits for the service to be ready, it gives up early if the service is in crash loop
+func (s *Service) WaitReady(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !s.Ready() {
+		s.stateMutex.Lock()
+		crashLoop := s.state == StateCrashLoop
+		s.stateMutex.Unlock()
+
+		if crashLoop || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// currentConf returns the configuration of the service, for the callers not holding s.mutex
+func (s *Service) currentConf() config.Service {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.conf
 }
 
 func (s *Service) IsRunning() bool {
@@ -175,41 +798,108 @@ func (s *Service) setRunning(value bool) {
 }
 
 func (s *Service) copyBinary() error {
-	// This will change with hotswap or history
-	if s.IsRunning() {
+	// Only a handoff runs two binaries at once
+	if s.IsRunning() && !s.handsOff() {
 		return fmt.Errorf("cannot change a binaryName of a running service")
 	}
 
+	// Reuse the last copy if the binary did not change since
+	sourceHash, err := hashFile(s.conf.BinaryPath)
+	if err != nil {
+		return fmt.Errorf("error reading binary %s : %s", s.conf.BinaryPath, err)
+	}
+	s.stateMutex.Lock()
+	if last := len(s.history.Versions) - 1; last >= 0 && s.history.Versions[last].Hash == sourceHash {
+		binary := s.history.Versions[last]
+		if _, err = os.Stat(path.Clean(s.storage.Binaries + "/" + binary.File)); err == nil {
+			s.binaryName = binary.File
+			s.version = binary.Version
+			s.stateMutex.Unlock()
+			return nil
+		}
+	}
+	s.stateMutex.Unlock()
+
 	// Generate binary name
 	binaryName := ""
 	for nameIsUsed := true; nameIsUsed; {
-		binaryName = s.conf.Name + "-" + fmt.Sprintf("%08x", rand.Uint32())
+		binaryName = s.name + "-" + fmt.Sprintf("%08x", rand.Uint32())
 
-		if _, err := os.Stat(path.Clean(s.binaryStorageFolder + "/" + binaryName)); err != nil {
+		if _, err := os.Stat(path.Clean(s.storage.Binaries + "/" + binaryName)); err != nil {
 			// file does not exist
 			nameIsUsed = false
 		}
 	}
-	s.binaryName = binaryName
 
 	// Copy binary
-	err := copyFile(path.Clean(s.binaryStorageFolder+"/"+s.binaryName), s.conf.BinaryPath)
+	hash, size, err := copyFile(path.Clean(s.storage.Binaries+"/"+binaryName), s.conf.BinaryPath)
 	if err != nil {
-		return fmt.Errorf("error copying binary %s : %s", s.binaryName, err)
+		return fmt.Errorf("error copying binary %s : %s", binaryName, err)
 	}
 
-	err = os.Chmod(path.Clean(s.binaryStorageFolder+"/"+s.binaryName), 0755)
+	err = os.Chmod(path.Clean(s.storage.Binaries+"/"+binaryName), 0755)
+	if err != nil {
+		return fmt.Errorf("error making binary executable %s : %s", binaryName, err)
+	}
+
+	// Record it in history
+	s.stateMutex.Lock()
+	dropped := s.history.add(BinaryVersion{File: binaryName, Hash: hash, Size: size, Time: time.Now()}, s.storage.History)
+	s.binaryName = binaryName
+	s.version = s.history.Versions[len(s.history.Versions)-1].Version
+	err = s.history.save()
+	s.stateMutex.Unlock()
 	if err != nil {
-		return fmt.Errorf("error making binary executable %s : %s", s.binaryName, err)
+		logMessage(LevelError, s.name, fmt.Sprintf("Cannot save binary history of service %v: %v", s.name, err))
 	}
 
+	for _, binary := range dropped {
+		err = os.Remove(path.Clean(s.storage.Binaries + "/" + binary.File))
+		if err != nil && !os.IsNotExist(err) {
+			logMessage(LevelError, s.name, fmt.Sprintf("Cannot remove old binary %v: %v", binary.File, err))
+		}
+	}
+
+	if s.binaryCopied != nil {
+		s.binaryCopied()
+	}
 	return nil
 }
 
-func copyFile(dest string, source string) error {
+// BinaryChanged compares the content of the binary with the copy currently used by the service
+func (s *Service) BinaryChanged() (bool, error) {
+	hash, err := hashFile(s.currentConf().BinaryPath)
+	if err != nil {
+		return false, err
+	}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	current, ok := s.history.get(s.version)
+	return !ok || current.Hash != hash, nil
+}
+
+func hashFile(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyFile copies source to dest and returns the sha256 hash and the size of the copied content
+func copyFile(dest string, source string) (string, int64, error) {
 	destFile, err := os.Create(dest)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 	defer func() {
 		err = destFile.Close()
@@ -220,7 +910,7 @@ func copyFile(dest string, source string) error {
 
 	sourceFile, err := os.Open(source)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 	defer func() {
 		err = sourceFile.Close()
@@ -229,10 +919,11 @@ func copyFile(dest string, source string) error {
 		}
 	}()
 
-	_, err = io.Copy(destFile, sourceFile)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(destFile, hash), sourceFile)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
-	return nil
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
 }
@@ -0,0 +1,256 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/arnopensource/devo/config"
+)
+
+type handlerFunc func(args json.RawMessage) (interface{}, error)
+
+// streamHandlerFunc sends any number of results, until it returns or done is closed because the client left
+type streamHandlerFunc func(args json.RawMessage, send func(result interface{}) error, done chan bool) error
+
+// socketServer serves the control protocol on a unix socket
+// Handlers must all be registered before calling serve
+type socketServer struct {
+	listener       net.Listener
+	handlers       map[string]handlerFunc
+	streamHandlers map[string]streamHandlerFunc
+}
+
+func newSocketServer(sockFile string) (*socketServer, error) {
+	if _, err := os.Stat(sockFile); err == nil {
+		// The socket file may be left over by a daemon that did not exit properly
+		conn, err := net.DialTimeout("unix", sockFile, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, errors.New("another daemon is already listening on " + sockFile)
+		}
+		err = os.Remove(sockFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket file: %s", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", sockFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on socket file: %s", err)
+	}
+
+	err = os.Chmod(sockFile, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to restrict socket file permissions: %s", err)
+	}
+
+	return &socketServer{
+		listener:       listener,
+		handlers:       make(map[string]handlerFunc),
+		streamHandlers: make(map[string]streamHandlerFunc),
+	}, nil
+}
+
+func (s *socketServer) Handle(command string, handler handlerFunc) {
+	s.handlers[command] = handler
+}
+
+// HandleStream registers a command answering with a stream of responses
+// The connection is dedicated to the stream until it ends
+func (s *socketServer) HandleStream(command string, handler streamHandlerFunc) {
+	s.streamHandlers[command] = handler
+}
+
+func (s *socketServer) serve() {
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logMessage(LevelError, "", fmt.Sprint("Error accepting socket connection: ", err))
+				}
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+}
+
+func (s *socketServer) Close() {
+	err := s.listener.Close()
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprint("Error closing socket: ", err))
+	}
+}
+
+func (s *socketServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		var request Request
+		err := decoder.Decode(&request)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			encoder.Encode(Response{Version: ProtocolVersion, Error: "invalid request: " + err.Error()})
+			return
+		}
+
+		if handler, ok := s.streamHandlers[request.Command]; ok && request.Version == ProtocolVersion {
+			s.stream(conn, encoder, handler, request)
+			return
+		}
+
+		err = encoder.Encode(s.dispatch(request))
+		if err != nil {
+			logMessage(LevelError, "", fmt.Sprint("Error writing socket response: ", err))
+			return
+		}
+	}
+}
+
+func (s *socketServer) dispatch(request Request) Response {
+	response := Response{Version: ProtocolVersion}
+
+	if request.Version != ProtocolVersion {
+		response.Error = fmt.Sprintf("unsupported protocol version %d, daemon speaks version %d", request.Version, ProtocolVersion)
+		return response
+	}
+
+	handler, ok := s.handlers[request.Command]
+	if !ok {
+		response.Error = "unknown command: " + request.Command
+		return response
+	}
+
+	result, err := handler(request.Args)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	if result != nil {
+		response.Data, err = json.Marshal(result)
+		if err != nil {
+			response.Error = "unable to encode result: " + err.Error()
+		}
+	}
+	return response
+}
+
+func (s *socketServer) stream(conn net.Conn, encoder *json.Encoder, handler streamHandlerFunc, request Request) {
+	// The client does not send anything else, reading only tells when it leaves
+	done := make(chan bool)
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(done)
+	}()
+
+	send := func(result interface{}) error {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(Response{Version: ProtocolVersion, Data: data, More: true})
+	}
+
+	response := Response{Version: ProtocolVersion}
+	err := handler(request.Args, send, done)
+	if err != nil {
+		response.Error = err.Error()
+	}
+	encoder.Encode(response)
+}
+
+// Call sends a command to the running daemon through its control socket
+// args is encoded as the request arguments and the response data is decoded into result, both may be nil
+func Call(conf *config.Config, command string, args interface{}, result interface{}) error {
+	conn, err := net.DialTimeout("unix", conf.Storage.SockFile, time.Second)
+	if err != nil {
+		return fmt.Errorf("unable to connect to daemon: %s", err)
+	}
+	defer conn.Close()
+
+	request := Request{Version: ProtocolVersion, Command: command}
+	if args != nil {
+		request.Args, err = json.Marshal(args)
+		if err != nil {
+			return fmt.Errorf("unable to encode request: %s", err)
+		}
+	}
+
+	err = json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		return fmt.Errorf("unable to send request: %s", err)
+	}
+
+	var response Response
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %s", err)
+	}
+
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+
+	if result != nil && response.Data != nil {
+		err = json.Unmarshal(response.Data, result)
+		if err != nil {
+			return fmt.Errorf("unable to decode response: %s", err)
+		}
+	}
+	return nil
+}
+
+// Stream sends a streaming command to the running daemon and calls receive with each result, until the stream ends
+func Stream(conf *config.Config, command string, args interface{}, receive func(data json.RawMessage) error) error {
+	conn, err := net.DialTimeout("unix", conf.Storage.SockFile, time.Second)
+	if err != nil {
+		return fmt.Errorf("unable to connect to daemon: %s", err)
+	}
+	defer conn.Close()
+
+	request := Request{Version: ProtocolVersion, Command: command}
+	if args != nil {
+		request.Args, err = json.Marshal(args)
+		if err != nil {
+			return fmt.Errorf("unable to encode request: %s", err)
+		}
+	}
+
+	err = json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		return fmt.Errorf("unable to send request: %s", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var response Response
+		err = decoder.Decode(&response)
+		if err != nil {
+			return fmt.Errorf("unable to read response: %s", err)
+		}
+
+		if response.Error != "" {
+			return errors.New(response.Error)
+		}
+		if !response.More {
+			return nil
+		}
+
+		err = receive(response.Data)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -18,11 +18,12 @@ import (
 //  kill `cat ~/.devo/devo.pid`
 
 // Fork is responsible for forking the process and starting the daemon
-func Fork(conf *config.Config) {
+// The configuration file name is kept by the daemon to reload it later
+func Fork(configFileName string, conf *config.Config) {
 	daemonCtx := &daemon.Context{
 		PidFileName: conf.Storage.PidFile,
 		PidFilePerm: 0644,
-		LogFileName: conf.Storage.Log,
+		LogFileName: config.UseDateInFilename(conf.Storage.Log),
 		LogFilePerm: 0640,
 		WorkDir:     "./",
 		Umask:       027,
@@ -40,7 +41,7 @@ func Fork(conf *config.Config) {
 	}
 
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	defer func() {
 		err = daemonCtx.Release()
@@ -49,7 +50,7 @@ func Fork(conf *config.Config) {
 		}
 	}()
 
-	run(conf, signalChannel)
+	run(configFileName, conf, signalChannel)
 }
 
 // RunDaemon checks if the code executes in the child (daemon) process
@@ -67,7 +68,7 @@ func RunDaemon(configFileName string) {
 		log.Fatal("Unable to parse config file: ", err)
 	}
 
-	Fork(conf)
+	Fork(configFileName, conf)
 	// Do not execute the rest of the main function
 	os.Exit(0)
 }
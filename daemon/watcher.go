@@ -1,7 +1,8 @@
 package daemon
 
 import (
-	"log"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -19,8 +20,8 @@ type Watcher struct {
 func NewWatcher() *Watcher {
 	internalWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Println("Error creating watcher: ", err)
-		log.Println("Devo will not be able to watch for changes")
+		logMessage(LevelError, "", fmt.Sprint("Error creating watcher: ", err))
+		logMessage(LevelWarn, "", "Devo will not be able to watch for changes")
 		return &Watcher{}
 	}
 
@@ -38,7 +39,7 @@ func (w *Watcher) Close() {
 	}
 	err := w.watcher.Close()
 	if err != nil {
-		log.Println("Error closing watcher: ", err)
+		logMessage(LevelError, "", fmt.Sprint("Error closing watcher: ", err))
 		return
 	}
 }
@@ -49,7 +50,17 @@ func (w *Watcher) Add(path string) {
 	}
 	err := w.watcher.Add(path)
 	if err != nil {
-		log.Println("Error adding path to watcher: ", err)
+		logMessage(LevelError, "", fmt.Sprint("Error adding path to watcher: ", err))
+	}
+}
+
+func (w *Watcher) Remove(path string) {
+	if w.watcher == nil {
+		return
+	}
+	err := w.watcher.Remove(path)
+	if err != nil {
+		logMessage(LevelError, "", fmt.Sprint("Error removing path from watcher: ", err))
 	}
 }
 
@@ -58,6 +69,8 @@ func (w *Watcher) watch() {
 		return
 	}
 
+	// Pending events, forgotten once sent so the many files of recursive watches do not pile up
+	var limiterMutex sync.Mutex
 	var limiter = make(map[fsnotify.Event]*time.Timer)
 
 	for {
@@ -66,18 +79,28 @@ func (w *Watcher) watch() {
 			if !ok {
 				return
 			}
-			if timer, ok := limiter[event]; ok {
+			limiterMutex.Lock()
+			if timer, ok := limiter[event]; ok && timer.Stop() {
 				timer.Reset(time.Second)
 			} else {
-				limiter[event] = time.AfterFunc(time.Second, func() {
+				var timer *time.Timer
+				timer = time.AfterFunc(time.Second, func() {
+					limiterMutex.Lock()
+					// The event may have come again since, with a new timer
+					if limiter[event] == timer {
+						delete(limiter, event)
+					}
+					limiterMutex.Unlock()
 					w.Events <- event
 				})
+				limiter[event] = timer
 			}
+			limiterMutex.Unlock()
 		case err, ok := <-w.watcher.Errors:
 			if !ok {
 				return
 			}
-			log.Println("Error while watching for changes:", err)
+			logMessage(LevelError, "", fmt.Sprint("Error while watching for changes: ", err))
 		}
 	}
 }
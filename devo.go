@@ -11,6 +11,9 @@ import (
 const devoConfigFile = "devo.toml"
 
 func main() {
+	// Run as the shim passing sockets to a service, before the daemon which would see its environment
+	daemon.RunListenShim()
+
 	// Hijack execution flow in child process
 	daemon.RunDaemon(devoConfigFile)
 
@@ -47,5 +50,5 @@ func main() {
 	//time.Sleep(1 * time.Second)
 	//
 	//fmt.Println("Starting daemon")
-	//daemon.Fork(conf)
+	//daemon.Fork(devoConfigFile, conf)
 }